@@ -0,0 +1,390 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	defaultBaselineRuns = 20
+	minBaselineRuns     = 3 //baseline rules are not evaluated until there is this much history
+	defaultAlertWindow  = 10
+)
+
+var (
+	alertsPath string
+	alerting   *alertConfig
+)
+
+// alertConfig is the rules file given with -alerts
+type alertConfig struct {
+	StateFile string      `json:"state_file"` //defaults to the rules file with a .state suffix
+	Webhooks  []webhook   `json:"webhooks"`
+	Rules     []alertRule `json:"rules"`
+
+	state map[string]*alertState
+}
+
+type webhook struct {
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers"`
+	ContentType string            `json:"content_type"` //defaults to application/json
+	Template    string            `json:"template"`     //text/template body, the alert as JSON by default
+
+	tmpl *template.Template
+}
+
+// alertRule is a condition over recent history.  A rule either compares every one of the last
+// Consecutive runs, or an Aggregate of the last Window runs, against Value or a percentage of the
+// baseline, the median of the BaselineRuns before them.
+type alertRule struct {
+	Name            string  `json:"name"`
+	Metric          string  `json:"metric"`           //download, upload, latency, jitter or failed
+	Op              string  `json:"op"`               //"<" or ">"
+	Value           float64 `json:"value"`            //bps for speeds, ms for latency and jitter
+	BaselinePercent float64 `json:"baseline_percent"` //compare with this percentage of the baseline instead of Value
+	BaselineRuns    int     `json:"baseline_runs"`
+	Consecutive     int     `json:"consecutive"`
+	Aggregate       string  `json:"aggregate"` //min, max, mean or a percentile such as p90
+	Window          int     `json:"window"`
+}
+
+// alertState is the persisted state of a rule, used to only notify on changes
+type alertState struct {
+	Firing bool      `json:"firing"`
+	Since  time.Time `json:"since"`
+}
+
+// alert is the notification sent to webhooks, and the data given to body templates
+type alert struct {
+	Rule      string     `json:"rule"`
+	State     string     `json:"state"`
+	Metric    string     `json:"metric"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Baseline  float64    `json:"baseline,omitempty"`
+	Since     time.Time  `json:"since"`
+	Time      time.Time  `json:"time"`
+	Host      string     `json:"host"`
+	Interface string     `json:"interface,omitempty"`
+	Server    jsonServer `json:"server"`
+}
+
+var alertFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"speed": func(v float64) string {
+		return humanSpeed(uint64(v))
+	},
+}
+
+func addAlertFlags(fs *flag.FlagSet) {
+	fs.StringVar(&alertsPath, "alerts", "", "JSON file of alert rules evaluated against the history after each test")
+}
+
+// loadAlerts loads the alert rules given on the command line, if any
+func loadAlerts() error {
+	if alertsPath == "" {
+		return nil
+	}
+	if hist == nil {
+		return errors.New("Alert rules are evaluated against the history, which is disabled")
+	}
+	buff, err := ioutil.ReadFile(alertsPath)
+	if err != nil {
+		return err
+	}
+	ac := &alertConfig{}
+	if err = json.Unmarshal(buff, ac); err != nil {
+		return fmt.Errorf("Invalid alert rules %s: %v", alertsPath, err)
+	}
+	if err = ac.validate(); err != nil {
+		return fmt.Errorf("Invalid alert rules %s: %v", alertsPath, err)
+	}
+	if ac.StateFile == "" {
+		ac.StateFile = alertsPath + ".state"
+	}
+	ac.state = make(map[string]*alertState)
+	if buff, err = ioutil.ReadFile(ac.StateFile); err == nil {
+		if err = json.Unmarshal(buff, &ac.state); err != nil {
+			return fmt.Errorf("Invalid alert state %s: %v", ac.StateFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	alerting = ac
+	return nil
+}
+
+func (ac *alertConfig) validate() error {
+	names := make(map[string]bool)
+	for i := range ac.Rules {
+		r := &ac.Rules[i]
+		if r.Name == "" || names[r.Name] {
+			return fmt.Errorf("rule %d needs a unique name", i)
+		}
+		names[r.Name] = true
+		switch r.Metric {
+		case "download", "upload", "latency", "jitter", "failed":
+		default:
+			return fmt.Errorf("rule %s has unknown metric %q", r.Name, r.Metric)
+		}
+		if r.Op != "<" && r.Op != ">" {
+			return fmt.Errorf("rule %s has unknown op %q", r.Name, r.Op)
+		}
+		if r.Aggregate != "" {
+			if _, err := aggregate(r.Aggregate, nil); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+		if r.Consecutive < 0 || r.Window < 0 || r.BaselineRuns < 0 || r.BaselinePercent < 0 {
+			return fmt.Errorf("rule %s has a negative count or percentage", r.Name)
+		}
+	}
+	for i := range ac.Webhooks {
+		wh := &ac.Webhooks[i]
+		if wh.URL == "" {
+			return fmt.Errorf("webhook %d has no url", i)
+		}
+		if wh.Template != "" {
+			var err error
+			if wh.tmpl, err = template.New(wh.URL).Funcs(alertFuncs).Parse(wh.Template); err != nil {
+				return fmt.Errorf("webhook %s: %v", wh.URL, err)
+			}
+		}
+	}
+	return nil
+}
+
+// evaluateAlerts evaluates every rule against the history of the interface a result
+// was measured on, and notifies the webhooks of rules which started or stopped firing
+func evaluateAlerts(res *stdn.Result) {
+	if alerting == nil {
+		return
+	}
+	hes, err := hist.Query(stdn.HistoryFilter{Interface: res.Interface})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read history for alerts: %v\n", err)
+		return
+	}
+	host, _ := os.Hostname()
+	changed := false
+	for _, r := range alerting.Rules {
+		firing, a, ok := r.evaluate(hes)
+		if !ok {
+			continue
+		}
+		st, ok := alerting.state[r.Name]
+		if !ok {
+			st = &alertState{}
+			alerting.state[r.Name] = st
+		}
+		if st.Firing == firing {
+			continue
+		}
+		changed = true
+		//a resolved alert reports when it started firing
+		a.Since = st.Since
+		a.State = alertResolved
+		if firing {
+			a.Since = res.End
+			a.State = alertFiring
+		}
+		st.Firing = firing
+		st.Since = res.End
+		a.Time = res.End
+		a.Host = host
+		a.Interface = res.Interface
+		a.Server = newJSONServer(res.Server)
+		alerting.notify(a)
+	}
+	if changed {
+		buff, err := json.Marshal(alerting.state)
+		if err == nil {
+			err = writeFileAtomic(alerting.StateFile, buff)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save alert state: %v\n", err)
+		}
+	}
+}
+
+// evaluate checks the rule against the history, ok is false if there is not enough history
+func (r alertRule) evaluate(hes []stdn.HistoryEntry) (firing bool, a alert, ok bool) {
+	var vals []float64
+	for _, he := range hes {
+		if v, ok := metricValue(r.Metric, he); ok {
+			vals = append(vals, v)
+		}
+	}
+	n := r.Consecutive
+	if r.Aggregate != "" {
+		if n = r.Window; n == 0 {
+			n = defaultAlertWindow
+		}
+	} else if n == 0 {
+		n = 1
+	}
+	if len(vals) < n {
+		return
+	}
+	recent, older := vals[len(vals)-n:], vals[:len(vals)-n]
+	a = alert{Rule: r.Name, Metric: r.Metric, Threshold: r.Value}
+	if r.BaselinePercent > 0 {
+		bn := r.BaselineRuns
+		if bn == 0 {
+			bn = defaultBaselineRuns
+		}
+		if len(older) > bn {
+			older = older[len(older)-bn:]
+		}
+		if len(older) < minBaselineRuns {
+			return
+		}
+		a.Baseline = newStat(older).Median
+		a.Threshold = a.Baseline * r.BaselinePercent / 100
+	}
+	breach := func(v float64) bool {
+		if r.Op == "<" {
+			return v < a.Threshold
+		}
+		return v > a.Threshold
+	}
+	if r.Aggregate != "" {
+		a.Value, _ = aggregate(r.Aggregate, recent)
+		return breach(a.Value), a, true
+	}
+	firing = true
+	for _, v := range recent {
+		firing = firing && breach(v)
+	}
+	a.Value = recent[len(recent)-1]
+	return firing, a, true
+}
+
+// metricValue extracts a rule metric from a history entry, failed tests only have the failed metric
+func metricValue(metric string, he stdn.HistoryEntry) (float64, bool) {
+	if metric == "failed" {
+		if he.Error != "" {
+			return 1, true
+		}
+		return 0, true
+	}
+	if he.Error != "" {
+		return 0, false
+	}
+	switch {
+	case metric == "download" && he.Download != nil:
+		return float64(he.Download.Bps), true
+	case metric == "upload" && he.Upload != nil:
+		return float64(he.Upload.Bps), true
+	case metric == "latency" && he.Latency != nil:
+		return he.Latency.Median, true
+	case metric == "jitter" && he.Latency != nil:
+		return he.Latency.Jitter, true
+	}
+	return 0, false
+}
+
+// aggregate reduces values with min, max, mean or a percentile such as p90
+func aggregate(name string, vals []float64) (float64, error) {
+	switch name {
+	case "min", "max", "mean":
+	default:
+		if !strings.HasPrefix(name, "p") {
+			return 0, fmt.Errorf("unknown aggregate %q", name)
+		}
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentile %q", name)
+		}
+		if len(vals) == 0 {
+			return 0, nil
+		}
+		s := append([]float64{}, vals...)
+		sort.Float64s(s)
+		//nearest rank
+		return s[int(math.Ceil(p/100*float64(len(s))))-1], nil
+	}
+	st := newStat(vals)
+	if st == nil {
+		return 0, nil
+	}
+	switch name {
+	case "min":
+		return st.Min, nil
+	case "max":
+		return st.Max, nil
+	}
+	return st.Mean, nil
+}
+
+// notify sends an alert to every webhook
+func (ac *alertConfig) notify(a alert) {
+	fmt.Fprintf(os.Stderr, "Alert %s %s: %s %.02f, threshold %.02f\n", a.Rule, a.State, a.Metric, a.Value, a.Threshold)
+	for _, wh := range ac.Webhooks {
+		var body []byte
+		var err error
+		if wh.tmpl != nil {
+			var bb bytes.Buffer
+			err = wh.tmpl.Execute(&bb, a)
+			body = bb.Bytes()
+		} else {
+			body, err = json.Marshal(a)
+		}
+		if err == nil {
+			ct := wh.ContentType
+			if ct == "" {
+				ct = "application/json"
+			}
+			var hdrs []string
+			for k, v := range wh.Headers {
+				hdrs = append(hdrs, k+": "+v)
+			}
+			err = postRetry(wh.URL, ct, hdrs, body)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send alert %s to %s: %v\n", a.Rule, wh.URL, err)
+		}
+	}
+}
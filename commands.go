@@ -0,0 +1,440 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bndr/gotabulate"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+	"github.com/traetox/speedtest/version"
+)
+
+const (
+	defaultCommand = "test"
+	defaultListLen = 20
+)
+
+// command is a CLI subcommand, each parses its own flags
+type command struct {
+	name  string
+	args  string //argument synopsis shown in the usage
+	short string //one line description for the command list
+	long  string //full description for the command help
+	run   func(args []string)
+}
+
+var commands []*command
+
+func init() {
+	//assigned in init because the help command refers back to the command list
+	commands = []*command{
+		{
+			name:  "test",
+			args:  "[flags]",
+			short: "Run a latency and bandwidth test (default)",
+			long: "Run a latency, download and upload test, or only the phases given with -phases.\n" +
+				"Without -a or -id the candidate servers are listed and an interactive session starts,\n" +
+				"type \"help\" in it for the commands to test and compare them.",
+			run: runTest,
+		},
+		{
+			name:  "ping",
+			args:  "[flags]",
+			short: "Run a latency test only",
+			long:  "Run a latency test against the best scoring server, or the one selected with -s or -id.",
+			run:   runPing,
+		},
+		{
+			name:  "list",
+			args:  "[flags]",
+			short: "List servers by distance",
+			long:  "List servers sorted by distance, the IDs shown can be used with -id.",
+			run:   runList,
+		},
+		{
+			name:  "history",
+			args:  "[flags]",
+			short: "Show past results",
+			long: "Show the results recorded by test and ping, optionally filtered by date, server or\n" +
+				"interface, as a table or as sparklines of the trends.",
+			run: runHistory,
+		},
+		{
+			name:  "exporter",
+			args:  "[flags]",
+			short: "Serve test results as Prometheus metrics",
+			long: "Serve the latest test result on /metrics for Prometheus.  By default a scrape runs a\n" +
+				"test when the last one is older than -max-age, with -interval tests run on a schedule\n" +
+				"and scrapes only read the latest result.",
+			run: runExporter,
+		},
+		{
+			name:  "tui",
+			args:  "[flags]",
+			short: "Full screen dashboard for comparing servers",
+			long: "Show a full screen dashboard listing the probed servers by score.  Tests are started and\n" +
+				"canceled with keys while live charts show the throughput and the latency under load, and\n" +
+				"the tests of the session are kept in a table for comparison.",
+			run: runTUI,
+		},
+		{
+			name:  "servers",
+			args:  "refresh [flags]",
+			short: "Manage the cached server list",
+			long: "\"servers refresh\" downloads the live server list into the user cache directory,\n" +
+				"where it is used in preference to the built-in list when the live list is unreachable.",
+			run: runServers,
+		},
+		{
+			name:  "version",
+			short: "Print the version",
+			long:  "Print the version and exit.",
+			run:   runVersion,
+		},
+		{
+			name:  "help",
+			args:  "[command]",
+			short: "Show help for a command",
+			long:  "Show the list of commands, or the flags of a single command.",
+			run:   runHelp,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// usage prints the list of commands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: speedtest [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"speedtest help <command>\" for the flags of a command.\n")
+}
+
+// flagSet creates the flag set for a command with a usage message built from its help
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: speedtest %s %s\n\n%s\n", c.name, c.args, c.long)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parse parses the command flags and records which of them were explicitly set
+func parse(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "csv-header" {
+			csvHeaderSet = true
+		}
+	})
+	if !validFormat(format) {
+		fmt.Fprintf(os.Stderr, "Invalid output format %q\n", format)
+		os.Exit(exitArgs)
+	}
+	if _, err := csvDelimiter(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitArgs)
+	}
+}
+
+func addConfigFlags(fs *flag.FlagSet) {
+	fs.Var(&configURLs, "config-url", "Client configuration URL, repeat or comma separate to list mirrors tried in order")
+	fs.Var(&serverURLs, "servers-url", "Server list URL, repeat or comma separate to list mirrors tried in order")
+	fs.StringVar(&userAgent, "user-agent", stdn.DefaultUserAgent, "User agent used when fetching the configuration")
+	fs.BoolVar(&noHTTPFallback, "no-http-fallback", false, "Do not retry failed HTTPS configuration requests over plain HTTP")
+	fs.StringVar(&location, "location", "", "Override the client location with \"lat,lon\"")
+	fs.StringVar(&city, "city", "", "Override the client location with a city name, e.g. \"Portland, US\"")
+}
+
+func addSelectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&search, "s", "", "Server name substring to search candidate servers")
+	fs.UintVar(&serverID, "id", 0, "Select a server by its speedtest.net ID, see \"speedtest list\"")
+	fs.IntVar(&probeCandidates, "p", 10, "Number of nearest servers to latency probe during auto-selection")
+	fs.StringVar(&healthPath, "health", "", "Path to the server health store (default in the user cache directory)")
+}
+
+func addHistoryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&historyPath, "history", "", "Path to the result history (default in the user data directory)")
+	fs.BoolVar(&noHistory, "no-history", false, "Do not record the result in the history")
+}
+
+func addFormatFlag(fs *flag.FlagSet, help string) {
+	fs.StringVar(&format, "format", formatText, help)
+}
+
+func addCSVFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&csvHeaderFlag, "csv-header", true, "Print the CSV header row, disable when appending to an existing file")
+	fs.StringVar(&csvDelim, "csv-delimiter", ",", "Single character CSV field delimiter")
+}
+
+func runTest(args []string) {
+	var count int
+	var interval time.Duration
+	var rotate bool
+	fs := findCommand("test").flagSet()
+	addConfigFlags(fs)
+	addSelectFlags(fs)
+	addFormatFlag(fs, "Output format: text, json, csv, influx, nagios, ookla-json, ookla-csv, speedtest-cli-json or speedtest-cli-csv, machine readable formats imply -a")
+	addCSVFlags(fs)
+	fs.BoolVar(&auto, "a", false, "Auto-select best scoring candidate server")
+	fs.IntVar(&speedtestDuration, "t", 3, "Target duration for speedtests (in seconds)")
+	fs.StringVar(&interface_id, "I", "", "Select which interface you would like to run the speed test on")
+	fs.StringVar(&phases, "phases", phases, "Comma separated test phases to run: latency, download, upload")
+	fs.IntVar(&count, "count", 1, "Number of times to run the test, a summary is printed after the runs")
+	fs.DurationVar(&interval, "interval", 0, "Time between the start of each run with -count, e.g. 5m")
+	addHistoryFlags(fs)
+	addSinkFlags(fs)
+	addAlertFlags(fs)
+	fs.BoolVar(&rotate, "rotate", false, "With -count, rotate through the candidate servers instead of testing one")
+	addThresholdFlags(fs, true)
+	addNagiosFlags(fs)
+	addUnitsFlag(fs)
+	addProgressFlag(fs)
+	parse(fs, args)
+	if nagiosMode {
+		format = formatNagios
+	}
+	if speedtestDuration <= 0 {
+		fail(errCodeArgs, errors.New("Invalid test duration"))
+	}
+	if count <= 0 || interval < 0 {
+		fail(errCodeArgs, errors.New("Invalid repeat count or interval"))
+	}
+	tp, err := testPlan()
+	if err != nil {
+		fail(errCodeArgs, err)
+	}
+	if err = limits.validate(tp); err != nil {
+		fail(errCodeArgs, err)
+	}
+	if err = validateNagios(tp); err != nil {
+		fail(errCodeArgs, err)
+	}
+	if format == formatNagios && count > 1 {
+		fail(errCodeArgs, errors.New("-format nagios runs a single test"))
+	}
+	if probeCandidates <= 0 {
+		fail(errCodeArgs, errors.New("Invalid probe candidate count"))
+	}
+
+	health = openHealthStore(healthPath)
+	hist = openHistory()
+	if err := loadAlerts(); err != nil {
+		fail(errCodeArgs, err)
+	}
+	cfg := getConfig()
+	testServers := candidateServers(cfg)
+	if count > 1 {
+		if !rotate {
+			testServers = []stdn.Testserver{selectServer(cfg, testServers, tp, !auto)}
+		}
+		repeatTest(cfg, testServers, tp, count, interval)
+		return
+	}
+	if !auto && textOutput() && len(testServers) > 1 {
+		//explore the candidates in an interactive session rather than testing one
+		runREPL(cfg, testServers, tp)
+		return
+	}
+	selServer := selectServer(cfg, testServers, tp, false)
+
+	// Perform the actual test
+	res, err := fullTest(cfg, selServer, tp)
+	recordResult(cfg, res, err)
+	if err != nil {
+		testFailed(err)
+	}
+	if format == formatNagios {
+		nagiosReport(res)
+	}
+	if err = writeResult(cfg, res); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+		os.Exit(exitOutput)
+	}
+	checkThresholds(res)
+}
+
+func runPing(args []string) {
+	fs := findCommand("ping").flagSet()
+	addConfigFlags(fs)
+	addSelectFlags(fs)
+	addFormatFlag(fs, "Output format: text, json or influx")
+	addHistoryFlags(fs)
+	addSinkFlags(fs)
+	addAlertFlags(fs)
+	addThresholdFlags(fs, false)
+	parse(fs, args)
+	if format != formatText && format != formatJSON && format != formatInflux {
+		fail(errCodeArgs, fmt.Errorf("Output format %q is not supported by ping", format))
+	}
+	if probeCandidates <= 0 {
+		fail(errCodeArgs, errors.New("Invalid probe candidate count"))
+	}
+
+	health = openHealthStore(healthPath)
+	hist = openHistory()
+	if err := loadAlerts(); err != nil {
+		fail(errCodeArgs, err)
+	}
+	cfg := getConfig()
+	tp := stdn.NewTestPlan()
+	tp.PingCount = fullTestCount
+	tp.Download, tp.Upload = false, false
+	selServer := selectServer(cfg, candidateServers(cfg), tp, false)
+	res, err := fullTest(cfg, selServer, tp)
+	recordResult(cfg, res, err)
+	if err != nil {
+		testFailed(err)
+	}
+	if err = writeResult(cfg, res); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+		os.Exit(exitOutput)
+	}
+	checkThresholds(res)
+}
+
+func runList(args []string) {
+	var count int
+	fs := findCommand("list").flagSet()
+	addConfigFlags(fs)
+	addFormatFlag(fs, "Output format: text or json")
+	fs.StringVar(&search, "s", "", "Only list servers whose name contains this substring")
+	fs.IntVar(&count, "n", defaultListLen, "Maximum number of servers to list, 0 lists all")
+	parse(fs, args)
+	if format != formatText && format != formatJSON {
+		fail(errCodeArgs, fmt.Errorf("Output format %q is not supported by list", format))
+	}
+
+	cfg := getConfig()
+	srvs := cfg.Servers
+	if search != "" {
+		var err error
+		if srvs, err = getSearchServers(cfg, search); err != nil {
+			fail(errCodeNoServers, err)
+		}
+	}
+	if count > 0 && len(srvs) > count {
+		srvs = srvs[:count]
+	}
+	if format == formatJSON {
+		js := []jsonServer{}
+		for i := range srvs {
+			js = append(js, newJSONServer(srvs[i]))
+		}
+		writeJSON(os.Stdout, js)
+		return
+	}
+	var data [][]string
+	for i := range srvs {
+		data = append(data, []string{fmt.Sprintf("%d", srvs[i].ID),
+			srvs[i].Name, srvs[i].Sponsor, srvs[i].Country,
+			fmt.Sprintf("%.02f", srvs[i].Distance)})
+	}
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"ID", "Name", "Sponsor", "Country", "Distance (km)"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+}
+
+func runServers(args []string) {
+	var out string
+	fs := findCommand("servers").flagSet()
+	fs.Var(&serverURLs, "servers-url", "Server list URL, repeat or comma separate to list mirrors tried in order")
+	fs.StringVar(&userAgent, "user-agent", stdn.DefaultUserAgent, "User agent used when fetching the server list")
+	fs.BoolVar(&noHTTPFallback, "no-http-fallback", false, "Do not retry failed HTTPS requests over plain HTTP")
+	fs.StringVar(&out, "o", "", "Output file (default is the server list cache in the user cache directory)")
+	if len(args) == 0 || args[0] != "refresh" {
+		//parsing handles -h, anything else is a usage error
+		parse(fs, args)
+		fs.Usage()
+		os.Exit(exitArgs)
+	}
+	parse(fs, args[1:])
+
+	srvs, err := newClient().GetServerList()
+	if err != nil {
+		fail(errCodeConfig, fmt.Errorf("Failed to get server list: %v", err))
+	}
+	if out == "" {
+		if out, err = stdn.DefaultServerCachePath(); err != nil {
+			fail(errCodeArgs, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		fail(errCodeOutput, err)
+	}
+	fout, err := os.Create(out)
+	if err != nil {
+		fail(errCodeOutput, err)
+	}
+	if err = stdn.WriteSnapshot(fout, srvs); err == nil {
+		err = fout.Close()
+	} else {
+		fout.Close()
+	}
+	if err != nil {
+		fail(errCodeOutput, fmt.Errorf("Failed to write server list: %v", err))
+	}
+	fmt.Printf("Saved %d servers to %s\n", len(srvs), out)
+}
+
+func runVersion(args []string) {
+	fmt.Printf("Speedtest v%s\n", version.Version)
+}
+
+func runHelp(args []string) {
+	if len(args) == 0 {
+		usage()
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(exitArgs)
+	}
+	//running the command with -h prints the usage along with the command specific flags
+	c.run([]string{"-h"})
+}
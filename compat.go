@@ -0,0 +1,338 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// Output formats which reproduce the schemas of other speedtest clients so this
+// tool can be dropped into existing pipelines.  The Ookla formats follow the
+// official Ookla speedtest CLI 1.x and the speedtest-cli formats follow the
+// Python speedtest-cli 2.x.
+const (
+	formatOoklaJSON        = "ookla-json"
+	formatOoklaCSV         = "ookla-csv"
+	formatSpeedtestCLIJSON = "speedtest-cli-json"
+	formatSpeedtestCLICSV  = "speedtest-cli-csv"
+
+	speedtestCLITimeFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+var (
+	ooklaCSVHeader        = []string{"server name", "server id", "latency", "jitter", "packet loss", "download", "upload", "download bytes", "upload bytes", "share url"}
+	speedtestCLICSVHeader = []string{"Server ID", "Sponsor", "Server Name", "Timestamp", "Distance", "Ping", "Download", "Upload", "Share", "IP Address"}
+)
+
+type ooklaResult struct {
+	Type       string         `json:"type"`
+	Timestamp  string         `json:"timestamp"`
+	Ping       ooklaPing      `json:"ping"`
+	Download   ooklaTransfer  `json:"download"`
+	Upload     ooklaTransfer  `json:"upload"`
+	PacketLoss float64        `json:"packetLoss"`
+	ISP        string         `json:"isp"`
+	Interface  ooklaInterface `json:"interface"`
+	Server     ooklaServer    `json:"server"`
+	Result     ooklaShare     `json:"result"`
+}
+
+type ooklaPing struct {
+	Jitter  float64 `json:"jitter"`
+	Latency float64 `json:"latency"`
+	Low     float64 `json:"low"`
+	High    float64 `json:"high"`
+}
+
+type ooklaTransfer struct {
+	Bandwidth uint64 `json:"bandwidth"` //bytes per second
+	Bytes     uint64 `json:"bytes"`
+	Elapsed   int64  `json:"elapsed"` //milliseconds
+}
+
+type ooklaInterface struct {
+	InternalIP string `json:"internalIp"`
+	Name       string `json:"name"`
+	MacAddr    string `json:"macAddr"`
+	IsVpn      bool   `json:"isVpn"`
+	ExternalIP string `json:"externalIp"`
+}
+
+type ooklaServer struct {
+	ID       uint   `json:"id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Country  string `json:"country"`
+	IP       string `json:"ip"`
+}
+
+type ooklaShare struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Persisted bool   `json:"persisted"`
+}
+
+type speedtestCLIResult struct {
+	Download      float64                `json:"download"`
+	Upload        float64                `json:"upload"`
+	Ping          float64                `json:"ping"`
+	Server        speedtestCLIServer     `json:"server"`
+	Timestamp     string                 `json:"timestamp"`
+	BytesSent     uint64                 `json:"bytes_sent"`
+	BytesReceived uint64                 `json:"bytes_received"`
+	Share         *string                `json:"share"`
+	Client        map[string]interface{} `json:"client"`
+}
+
+type speedtestCLIServer struct {
+	URL      string  `json:"url"`
+	Lat      string  `json:"lat"`
+	Long     string  `json:"lon"`
+	Name     string  `json:"name"`
+	Country  string  `json:"country"`
+	CC       string  `json:"cc"`
+	Sponsor  string  `json:"sponsor"`
+	ID       string  `json:"id"`
+	Host     string  `json:"host"`
+	Distance float64 `json:"d"`
+	Latency  float64 `json:"latency"`
+}
+
+func compatFormat(f string) bool {
+	switch f {
+	case formatOoklaJSON, formatOoklaCSV, formatSpeedtestCLIJSON, formatSpeedtestCLICSV:
+		return true
+	}
+	return false
+}
+
+// writeCompatResult writes a result in one of the compatible formats, like the
+// originals the JSON is written on a single line
+func writeCompatResult(w io.Writer, cfg *stdn.Config, res *stdn.Result) error {
+	switch format {
+	case formatOoklaJSON:
+		return json.NewEncoder(w).Encode(newOoklaResult(cfg, res))
+	case formatOoklaCSV:
+		return writeOoklaCSV(w, res, compatCSVHeader())
+	case formatSpeedtestCLIJSON:
+		return json.NewEncoder(w).Encode(newSpeedtestCLIResult(cfg, res))
+	case formatSpeedtestCLICSV:
+		return writeSpeedtestCLICSV(w, cfg, res, compatCSVHeader())
+	}
+	return nil
+}
+
+// compatCSVHeader reports whether a header was asked for, the tools we are
+// compatible with only print one when explicitly requested
+func compatCSVHeader() bool {
+	return csvHeaderSet && csvHeaderFlag
+}
+
+func newOoklaResult(cfg *stdn.Config, res *stdn.Result) ooklaResult {
+	or := ooklaResult{
+		Type:      "result",
+		Timestamp: res.Start.UTC().Format(time.RFC3339),
+		ISP:       cfg.ISP,
+		Interface: ooklaInterface{
+			Name: res.Interface,
+		},
+		Server: ooklaServer{
+			ID:       res.Server.ID,
+			Name:     res.Server.Sponsor,
+			Location: res.Server.Name,
+			Country:  res.Server.Country,
+		},
+	}
+	if cfg.IP != nil {
+		or.Interface.ExternalIP = cfg.IP.String()
+	}
+	or.Interface.InternalIP, or.Interface.MacAddr = interfaceAddrs(res.Interface)
+	if host, port, err := net.SplitHostPort(res.Server.Host); err == nil {
+		or.Server.Host = host
+		or.Server.Port, _ = strconv.Atoi(port)
+	} else {
+		or.Server.Host = res.Server.Host
+	}
+	if ls := res.Latency; ls != nil {
+		or.Ping = ooklaPing{
+			Jitter:  ms(ls.Jitter),
+			Latency: ms(ls.Median),
+			Low:     ms(ls.Min),
+			High:    ms(ls.Max),
+		}
+	}
+	or.Download = newOoklaTransfer(res.Download)
+	or.Upload = newOoklaTransfer(res.Upload)
+	return or
+}
+
+func newOoklaTransfer(xfer *stdn.Transfer) ooklaTransfer {
+	if xfer == nil {
+		return ooklaTransfer{}
+	}
+	return ooklaTransfer{
+		Bandwidth: xfer.Bps / 8,
+		Bytes:     xfer.Bytes,
+		Elapsed:   xfer.Duration.Milliseconds(),
+	}
+}
+
+// interfaceAddrs returns the first IP and the hardware address of a named interface
+func interfaceAddrs(name string) (ip, mac string) {
+	if name == "" {
+		return
+	}
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return
+	}
+	mac = intf.HardwareAddr.String()
+	if addrs, err := intf.Addrs(); err == nil && len(addrs) > 0 {
+		if ipn, ok := addrs[0].(*net.IPNet); ok {
+			ip = ipn.IP.String()
+		}
+	}
+	return
+}
+
+// writeOoklaCSV writes a result the way the Ookla CLI does, with every field quoted
+func writeOoklaCSV(w io.Writer, res *stdn.Result, header bool) error {
+	if header {
+		if err := writeQuotedCSV(w, ooklaCSVHeader); err != nil {
+			return err
+		}
+	}
+	or := newOoklaResult(&stdn.Config{}, res)
+	return writeQuotedCSV(w, []string{
+		res.Server.Sponsor + " - " + res.Server.Name,
+		strconv.FormatUint(uint64(res.Server.ID), 10),
+		strconv.FormatFloat(or.Ping.Latency, 'f', 3, 64),
+		strconv.FormatFloat(or.Ping.Jitter, 'f', 3, 64),
+		"0",
+		strconv.FormatUint(or.Download.Bandwidth, 10),
+		strconv.FormatUint(or.Upload.Bandwidth, 10),
+		strconv.FormatUint(or.Download.Bytes, 10),
+		strconv.FormatUint(or.Upload.Bytes, 10),
+		"",
+	})
+}
+
+func writeQuotedCSV(w io.Writer, rec []string) error {
+	flds := make([]string, len(rec))
+	for i := range rec {
+		flds[i] = `"` + strings.ReplaceAll(rec[i], `"`, `""`) + `"`
+	}
+	_, err := io.WriteString(w, strings.Join(flds, ",")+"\n")
+	return err
+}
+
+func newSpeedtestCLIResult(cfg *stdn.Config, res *stdn.Result) speedtestCLIResult {
+	sr := speedtestCLIResult{
+		Timestamp: res.Start.UTC().Format(speedtestCLITimeFormat),
+		Server: speedtestCLIServer{
+			Lat:      strconv.FormatFloat(res.Server.Lat, 'f', -1, 64),
+			Long:     strconv.FormatFloat(res.Server.Long, 'f', -1, 64),
+			Name:     res.Server.Name,
+			Country:  res.Server.Country,
+			CC:       res.Server.CC,
+			Sponsor:  res.Server.Sponsor,
+			ID:       strconv.FormatUint(uint64(res.Server.ID), 10),
+			Host:     res.Server.Host,
+			Distance: res.Server.Distance,
+		},
+		Client: map[string]interface{}{
+			"ip":        "",
+			"lat":       strconv.FormatFloat(cfg.Lat, 'f', -1, 64),
+			"lon":       strconv.FormatFloat(cfg.Long, 'f', -1, 64),
+			"isp":       cfg.ISP,
+			"isprating": "",
+			"rating":    "0",
+			"ispdlavg":  strconv.FormatUint(cfg.ISPDlAvg/1000, 10),
+			"ispulavg":  strconv.FormatUint(cfg.ISPUpAvg/1000, 10),
+			"loggedin":  "0",
+			"country":   cfg.Country,
+		},
+	}
+	if cfg.IP != nil {
+		sr.Client["ip"] = cfg.IP.String()
+	}
+	if len(res.Server.URLs) > 0 {
+		sr.Server.URL = res.Server.URLs[0]
+	}
+	if res.Latency != nil {
+		sr.Ping = ms(res.Latency.Median)
+		sr.Server.Latency = sr.Ping
+	}
+	if res.Download != nil {
+		sr.Download = float64(res.Download.Bps)
+		sr.BytesReceived = res.Download.Bytes
+	}
+	if res.Upload != nil {
+		sr.Upload = float64(res.Upload.Bps)
+		sr.BytesSent = res.Upload.Bytes
+	}
+	return sr
+}
+
+// writeSpeedtestCLICSV writes a result the way speedtest-cli --csv does
+func writeSpeedtestCLICSV(w io.Writer, cfg *stdn.Config, res *stdn.Result, header bool) error {
+	delim, err := csvDelimiter()
+	if err != nil {
+		return err
+	}
+	sr := newSpeedtestCLIResult(cfg, res)
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	if header {
+		if err := cw.Write(speedtestCLICSVHeader); err != nil {
+			return err
+		}
+	}
+	err = cw.Write([]string{
+		sr.Server.ID,
+		sr.Server.Sponsor,
+		sr.Server.Name,
+		sr.Timestamp,
+		strconv.FormatFloat(sr.Server.Distance, 'f', -1, 64),
+		strconv.FormatFloat(sr.Ping, 'f', -1, 64),
+		strconv.FormatFloat(sr.Download, 'f', -1, 64),
+		strconv.FormatFloat(sr.Upload, 'f', -1, 64),
+		"",
+		sr.Client["ip"].(string),
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,236 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	defaultListenAddr = ":9516"
+	metricsPath       = "/metrics"
+	metricsType       = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// failureClasses are the error codes counted by the exporter, listed so every
+// counter is exported from the start rather than appearing on the first failure
+var failureClasses = []string{errCodeNoServers, errCodeTimeout, errCodeDisconnect, errCodeTest}
+
+// exporter serves the most recent test result as Prometheus metrics
+type exporter struct {
+	mtx       sync.Mutex //held while a test runs, so tests never overlap
+	cfg       *stdn.Config
+	tp        stdn.TestPlan
+	maxAge    time.Duration //age at which a scrape triggers a new test, zero when tests are scheduled
+	last      *stdn.Result  //most recent successful test
+	attempted time.Time     //start of the most recent test, successful or not
+	tests     uint64
+	failures  map[string]uint64
+}
+
+func runExporter(args []string) {
+	var listen string
+	var interval, maxAge time.Duration
+	fs := findCommand("exporter").flagSet()
+	addConfigFlags(fs)
+	addSelectFlags(fs)
+	addHistoryFlags(fs)
+	addSinkFlags(fs)
+	addAlertFlags(fs)
+	fs.StringVar(&listen, "listen", defaultListenAddr, "Address to serve metrics on")
+	fs.DurationVar(&interval, "interval", 0, "Run tests on this schedule, e.g. 30m, rather than when scraped")
+	fs.DurationVar(&maxAge, "max-age", 15*time.Minute, "When tests run on scrape, reuse results younger than this")
+	fs.IntVar(&speedtestDuration, "t", 3, "Target duration for speedtests (in seconds)")
+	fs.StringVar(&interface_id, "I", "", "Select which interface you would like to run the speed test on")
+	fs.StringVar(&phases, "phases", phases, "Comma separated test phases to run: latency, download, upload")
+	parse(fs, args)
+	if speedtestDuration <= 0 || probeCandidates <= 0 {
+		fail(errCodeArgs, errors.New("Invalid test duration or probe candidate count"))
+	}
+	if interval < 0 || maxAge < 0 {
+		fail(errCodeArgs, errors.New("Invalid test interval or maximum result age"))
+	}
+	tp, err := testPlan()
+	if err != nil {
+		fail(errCodeArgs, err)
+	}
+
+	health = openHealthStore(healthPath)
+	hist = openHistory()
+	if err := loadAlerts(); err != nil {
+		fail(errCodeArgs, err)
+	}
+	e := &exporter{
+		cfg:      getConfig(),
+		tp:       tp,
+		maxAge:   maxAge,
+		failures: make(map[string]uint64),
+	}
+	if interval > 0 {
+		e.maxAge = 0
+		go e.schedule(interval)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><body><a href=%q>Metrics</a></body></html>\n", metricsPath)
+	})
+	log.Printf("Serving metrics on %s%s", listen, metricsPath)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		fail(errCodeArgs, err)
+	}
+}
+
+// schedule runs a test immediately and then on every interval
+func (e *exporter) schedule(interval time.Duration) {
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		e.mtx.Lock()
+		e.test()
+		e.mtx.Unlock()
+		<-tckr.C
+	}
+}
+
+// test selects a server and runs the test plan, the caller must hold the lock
+func (e *exporter) test() {
+	e.attempted = time.Now()
+	e.tests++
+	srv, err := e.selectServer()
+	if err != nil {
+		e.failures[errCodeNoServers]++
+		log.Printf("Server selection failed: %v", err)
+		return
+	}
+	res, err := srv.Run(e.tp)
+	recordResult(e.cfg, res, err)
+	if err != nil {
+		code, msg := testError(err)
+		e.failures[code]++
+		log.Printf("Test against %d (%s) failed: %v", srv.ID, srv.Sponsor, msg)
+		return
+	}
+	e.last = res
+	log.Printf("Test against %d (%s) completed in %s", srv.ID, srv.Sponsor, res.End.Sub(res.Start))
+}
+
+// selectServer picks the requested server, or the best scoring one at the time of the test,
+// matching how the test command selects without prompting
+func (e *exporter) selectServer() (stdn.Testserver, error) {
+	if serverID != 0 {
+		return getServerByID(e.cfg, serverID)
+	}
+	if search != "" {
+		srvs, err := getSearchServers(e.cfg, search)
+		if err != nil {
+			return stdn.Testserver{}, err
+		}
+		return srvs[0], nil
+	}
+	probes, err := autoGetTestServers(e.cfg)
+	if err != nil {
+		return stdn.Testserver{}, err
+	}
+	return *probes[0].Server, nil
+}
+
+// ServeHTTP writes the metrics, first running a test if the last one is too old
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mtx.Lock()
+	//concurrent scrapes wait on the lock and then find a fresh result
+	if e.maxAge > 0 && time.Since(e.attempted) >= e.maxAge {
+		e.test()
+	}
+	var sb strings.Builder
+	e.writeMetrics(&sb)
+	e.mtx.Unlock()
+	w.Header().Set("Content-Type", metricsType)
+	io.WriteString(w, sb.String())
+}
+
+// writeMetrics writes the Prometheus text exposition format, the caller must hold the lock
+func (e *exporter) writeMetrics(w io.Writer) {
+	metric(w, "speedtest_tests_total", "counter", "Number of tests attempted.")
+	fmt.Fprintf(w, "speedtest_tests_total %d\n", e.tests)
+	metric(w, "speedtest_test_failures_total", "counter", "Number of failed tests by error class.")
+	classes := append([]string{}, failureClasses...)
+	sort.Strings(classes)
+	for _, c := range classes {
+		fmt.Fprintf(w, "speedtest_test_failures_total{class=%s} %d\n", labelValue(c), e.failures[c])
+	}
+	if e.last == nil {
+		return
+	}
+	res := e.last
+	labels := fmt.Sprintf("server_id=%s,sponsor=%s,interface=%s",
+		labelValue(fmt.Sprintf("%d", res.Server.ID)), labelValue(res.Server.Sponsor), labelValue(res.Interface))
+	metric(w, "speedtest_last_success_timestamp_seconds", "gauge", "Time the last successful test finished.")
+	fmt.Fprintf(w, "speedtest_last_success_timestamp_seconds{%s} %d\n", labels, res.End.Unix())
+	metric(w, "speedtest_server_distance_kilometers", "gauge", "Distance to the server of the last successful test.")
+	fmt.Fprintf(w, "speedtest_server_distance_kilometers{%s} %g\n", labels, res.Server.Distance)
+	if ls := res.Latency; ls != nil {
+		metric(w, "speedtest_latency_seconds", "gauge", "Latency of the last successful test.")
+		for _, s := range []struct {
+			name string
+			d    time.Duration
+		}{{"avg", ls.Avg}, {"max", ls.Max}, {"median", ls.Median}, {"min", ls.Min}} {
+			fmt.Fprintf(w, "speedtest_latency_seconds{%s,stat=%s} %g\n", labels, labelValue(s.name), s.d.Seconds())
+		}
+		metric(w, "speedtest_jitter_seconds", "gauge", "Mean difference between consecutive pings of the last successful test.")
+		fmt.Fprintf(w, "speedtest_jitter_seconds{%s} %g\n", labels, ls.Jitter.Seconds())
+	}
+	if res.Download != nil {
+		metric(w, "speedtest_download_bits_per_second", "gauge", "Download speed of the last successful test.")
+		fmt.Fprintf(w, "speedtest_download_bits_per_second{%s} %d\n", labels, res.Download.Bps)
+	}
+	if res.Upload != nil {
+		metric(w, "speedtest_upload_bits_per_second", "gauge", "Upload speed of the last successful test.")
+		fmt.Fprintf(w, "speedtest_upload_bits_per_second{%s} %d\n", labels, res.Upload.Bps)
+	}
+}
+
+func metric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes and escapes a label value
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
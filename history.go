@@ -0,0 +1,178 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bndr/gotabulate"
+	"github.com/joliv/spark"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const historyTimeFormat = "2006-01-02 15:04"
+
+func runHistory(args []string) {
+	var since, until string
+	var last int
+	var sparks bool
+	var filter stdn.HistoryFilter
+	fs := findCommand("history").flagSet()
+	fs.StringVar(&historyPath, "history", "", "Path to the result history (default in the user data directory)")
+	addFormatFlag(fs, "Output format: text or json")
+	fs.StringVar(&since, "since", "", "Only show results at or after this date, time or age, e.g. 2024-01-31, 24h or 7d")
+	fs.StringVar(&until, "until", "", "Only show results before this date, time or age")
+	fs.UintVar(&filter.ServerID, "id", 0, "Only show results from this server ID")
+	fs.StringVar(&filter.Interface, "I", "", "Only show results from this interface")
+	fs.IntVar(&last, "n", 0, "Only show the most recent results, 0 shows all")
+	fs.BoolVar(&sparks, "spark", false, "Show sparklines of latency, download and upload instead of a table")
+	addUnitsFlag(fs)
+	parse(fs, args)
+	if format != formatText && format != formatJSON {
+		fail(errCodeArgs, fmt.Errorf("Output format %q is not supported by history", format))
+	}
+	var err error
+	if filter.Since, err = parseWhen(since); err != nil {
+		fail(errCodeArgs, err)
+	}
+	if filter.Until, err = parseWhen(until); err != nil {
+		fail(errCodeArgs, err)
+	}
+	if last < 0 {
+		fail(errCodeArgs, fmt.Errorf("Invalid result count %d", last))
+	}
+
+	if hist = openHistory(); hist == nil {
+		os.Exit(exitConfig)
+	}
+	hes, err := hist.Query(filter)
+	if err != nil {
+		fail(errCodeConfig, fmt.Errorf("Failed to read result history: %v", err))
+	}
+	if last > 0 && len(hes) > last {
+		hes = hes[len(hes)-last:]
+	}
+	switch {
+	case format == formatJSON:
+		if hes == nil {
+			hes = []stdn.HistoryEntry{}
+		}
+		err = writeJSON(os.Stdout, hes)
+	case len(hes) == 0:
+		fmt.Printf("No results recorded\n")
+	case sparks:
+		printHistorySparks(hes)
+	default:
+		printHistory(hes)
+	}
+	if err != nil {
+		fail(errCodeOutput, err)
+	}
+}
+
+// parseWhen parses a date, a date and time, or an age such as 24h or 7d
+func parseWhen(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(v, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(v, "d")); err == nil && days >= 0 {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	for _, f := range []string{time.RFC3339, historyTimeFormat, "2006-01-02"} {
+		if t, err := time.ParseInLocation(f, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date or age %q", v)
+}
+
+func printHistory(hes []stdn.HistoryEntry) {
+	var data [][]string
+	for _, he := range hes {
+		row := []string{he.Time.Local().Format(historyTimeFormat),
+			fmt.Sprintf("%d", he.Server.ID), he.Server.Sponsor, he.Interface}
+		if he.Latency != nil {
+			row = append(row, fmt.Sprintf("%.02fms", he.Latency.Median))
+		} else {
+			row = append(row, "-")
+		}
+		row = append(row, historySpeed(he.Download), historySpeed(he.Upload), he.Error)
+		data = append(data, row)
+	}
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"Time", "Server", "Sponsor", "Interface", "Latency", "Download", "Upload", "Error"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+}
+
+func historySpeed(xfer *stdn.HistoryTransfer) string {
+	if xfer == nil {
+		return "-"
+	}
+	return humanSpeed(xfer.Bps)
+}
+
+// printHistorySparks prints the trend of each metric across the results
+func printHistorySparks(hes []stdn.HistoryEntry) {
+	var lat, dl, ul []float64
+	failed := 0
+	for _, he := range hes {
+		if he.Error != "" {
+			failed++
+		}
+		if he.Latency != nil {
+			lat = append(lat, he.Latency.Median)
+		}
+		if he.Download != nil {
+			dl = append(dl, float64(he.Download.Bps))
+		}
+		if he.Upload != nil {
+			ul = append(ul, float64(he.Upload.Bps))
+		}
+	}
+	fmt.Printf("%d results, %d failed, from %s to %s\n", len(hes), failed,
+		hes[0].Time.Local().Format(historyTimeFormat), hes[len(hes)-1].Time.Local().Format(historyTimeFormat))
+	msCell := func(v float64) string { return fmt.Sprintf("%.02fms", v) }
+	bpsCell := func(v float64) string { return humanSpeed(uint64(v)) }
+	printSpark("Latency: ", lat, msCell)
+	printSpark("Download:", dl, bpsCell)
+	printSpark("Upload:  ", ul, bpsCell)
+}
+
+func printSpark(name string, vals []float64, f func(float64) string) {
+	st := newStat(vals)
+	if st == nil {
+		return
+	}
+	fmt.Printf("%s %s\t%s min\t%s median\t%s max\n", name, spark.Line(vals), f(st.Min), f(st.Median), f(st.Max))
+}
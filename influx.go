@@ -0,0 +1,239 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	formatInflux      = "influx"
+	influxMeasurement = "speedtest"
+	pushTimeout       = 10 * time.Second
+	pushRetries       = 3
+	pushBackoff       = time.Second
+	maxPushBuffer     = 8 * 1024 * 1024 //oldest buffered lines are dropped beyond this
+	maxPushErrorBody  = 512
+)
+
+var (
+	influxFile  string
+	pushURL     string
+	pushBuffer  string
+	pushHeaders stringList
+)
+
+func addSinkFlags(fs *flag.FlagSet) {
+	fs.StringVar(&influxFile, "influx-file", "", "Append each result to this file as InfluxDB line protocol")
+	fs.StringVar(&pushURL, "push-url", "", "POST each result as InfluxDB line protocol to this URL, e.g. http://influx:8086/write?db=net")
+	fs.StringVar(&pushBuffer, "push-buffer", "", "File buffering results while -push-url is unreachable (default in the user cache directory)")
+	fs.Var(&pushHeaders, "push-header", "Extra \"Name: value\" header sent with -push-url, may be repeated")
+}
+
+// sinkResult sends a successful result to the configured line protocol sinks
+func sinkResult(res *stdn.Result) {
+	if influxFile == "" && pushURL == "" {
+		return
+	}
+	line := influxLine(res)
+	if influxFile != "" {
+		if err := appendFile(influxFile, line); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", influxFile, err)
+		}
+	}
+	if pushURL != "" {
+		if err := push(line); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to push result: %v\n", err)
+		}
+	}
+}
+
+// writeInflux writes a result as a single line of InfluxDB line protocol
+func writeInflux(w io.Writer, res *stdn.Result) error {
+	_, err := io.WriteString(w, influxLine(res))
+	return err
+}
+
+// influxLine formats a result as line protocol, tags with empty values are omitted
+func influxLine(res *stdn.Result) string {
+	var sb strings.Builder
+	sb.WriteString(influxMeasurement)
+	tags := [][2]string{
+		{"interface", res.Interface},
+		{"server_id", strconv.FormatUint(uint64(res.Server.ID), 10)},
+		{"server_name", res.Server.Name},
+		{"sponsor", res.Server.Sponsor},
+	}
+	for _, t := range tags {
+		if t[1] != "" {
+			fmt.Fprintf(&sb, ",%s=%s", t[0], influxTagEscaper.Replace(t[1]))
+		}
+	}
+	fields := []string{"distance_km=" + strconv.FormatFloat(res.Server.Distance, 'f', -1, 64)}
+	if ls := res.Latency; ls != nil {
+		for _, f := range []struct {
+			name string
+			d    time.Duration
+		}{{"min", ls.Min}, {"avg", ls.Avg}, {"median", ls.Median}, {"max", ls.Max}, {"jitter", ls.Jitter}} {
+			fields = append(fields, fmt.Sprintf("latency_%s_ms=%s", f.name, strconv.FormatFloat(ms(f.d), 'f', -1, 64)))
+		}
+	}
+	if res.Download != nil {
+		fields = append(fields, fmt.Sprintf("download_bps=%di,download_bytes=%di", res.Download.Bps, res.Download.Bytes))
+	}
+	if res.Upload != nil {
+		fields = append(fields, fmt.Sprintf("upload_bps=%di,upload_bytes=%di", res.Upload.Bps, res.Upload.Bytes))
+	}
+	fmt.Fprintf(&sb, " %s %d\n", strings.Join(fields, ","), res.Start.UnixNano())
+	return sb.String()
+}
+
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", ``)
+
+// push sends a line along with any previously buffered lines, buffering them all
+// on disk if the endpoint cannot be reached
+func push(line string) error {
+	path := pushBuffer
+	if path == "" {
+		var err error
+		if path, err = stdn.DefaultPushBufferPath(); err != nil {
+			return err
+		}
+	}
+	buffered, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	body := append(buffered, line...)
+	if err = pushRetry(body); err == nil {
+		if len(buffered) > 0 {
+			return os.Remove(path)
+		}
+		return nil
+	}
+	if len(body) > maxPushBuffer {
+		body = body[len(body)-maxPushBuffer:]
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			body = body[i+1:]
+		}
+	}
+	if berr := writeFileAtomic(path, body); berr != nil {
+		return fmt.Errorf("%v, and buffering failed: %v", err, berr)
+	}
+	return fmt.Errorf("%v, buffered %d bytes in %s", err, len(body), path)
+}
+
+// pushRetry posts the line protocol body to the push URL
+func pushRetry(body []byte) error {
+	return postRetry(pushURL, "text/plain; charset=utf-8", pushHeaders, body)
+}
+
+// postRetry posts a body, backing off and retrying on network errors and temporary HTTP errors.
+// Headers are given as "Name: value".
+func postRetry(url, contentType string, headers []string, body []byte) error {
+	backoff := pushBackoff
+	for i := 0; ; i++ {
+		err := postOnce(url, contentType, headers, body)
+		if err == nil || i >= pushRetries {
+			return err
+		}
+		if herr, ok := err.(*stdn.HTTPError); ok && !herr.Temporary() {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postOnce(url, contentType string, headers []string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", stdn.DefaultUserAgent)
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q", h)
+		}
+		req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	clnt := http.Client{Timeout: pushTimeout}
+	resp, err := clnt.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		x, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxPushErrorBody))
+		return &stdn.HTTPError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       string(x),
+			Header:     resp.Header,
+		}
+	}
+	return nil
+}
+
+// appendFile appends data to a file, creating it and its directory if needed
+func appendFile(path, data string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fout, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(fout, data); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// writeFileAtomic replaces a file by writing a temporary file and renaming it
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
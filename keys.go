@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// key is a single key press, printable keys are the character itself
+type key string
+
+const (
+	keyUp        key = "up"
+	keyDown      key = "down"
+	keyLeft      key = "left"
+	keyRight     key = "right"
+	keyHome      key = "home"
+	keyEnd       key = "end"
+	keyPgUp      key = "pgup"
+	keyPgDn      key = "pgdn"
+	keyDel       key = "del"
+	keyEnter     key = "enter"
+	keyEsc       key = "esc"
+	keyTab       key = "tab"
+	keyBackspace key = "backspace"
+	keyCtrlC     key = "ctrl-c"
+	keyCtrlD     key = "ctrl-d"
+	keyUnknown   key = ""
+)
+
+var escapeKeys = map[string]key{
+	"[A": keyUp, "[B": keyDown, "[C": keyRight, "[D": keyLeft,
+	"[H": keyHome, "OH": keyHome, "[1~": keyHome, "[7~": keyHome,
+	"[F": keyEnd, "OF": keyEnd, "[4~": keyEnd, "[8~": keyEnd,
+	"[5~": keyPgUp, "[6~": keyPgDn, "[3~": keyDel,
+}
+
+// keyReader decodes key presses from a raw mode terminal
+type keyReader struct {
+	rdr *bufio.Reader
+}
+
+func newKeyReader(in io.Reader) *keyReader {
+	return &keyReader{rdr: bufio.NewReader(in)}
+}
+
+// next blocks until the next key press
+func (kr *keyReader) next() (key, error) {
+	r, _, err := kr.rdr.ReadRune()
+	if err != nil {
+		return keyUnknown, err
+	}
+	switch r {
+	case '\r', '\n':
+		return keyEnter, nil
+	case '\t':
+		return keyTab, nil
+	case 3:
+		return keyCtrlC, nil
+	case 4:
+		return keyCtrlD, nil
+	case 8, 127:
+		return keyBackspace, nil
+	case 27:
+		//a lone escape arrives on its own, sequences arrive in a single read
+		if kr.rdr.Buffered() == 0 {
+			return keyEsc, nil
+		}
+		return kr.escape(), nil
+	}
+	return key(r), nil
+}
+
+// readKeys sends key presses to keys until reading fails, then closes it
+func readKeys(kr *keyReader, keys chan<- key) {
+	for {
+		k, err := kr.next()
+		if err != nil {
+			close(keys)
+			return
+		}
+		keys <- k
+	}
+}
+
+// escape reads the rest of an escape sequence up to its final byte
+func (kr *keyReader) escape() key {
+	var seq []byte
+	for kr.rdr.Buffered() > 0 {
+		b, err := kr.rdr.ReadByte()
+		if err != nil {
+			break
+		}
+		seq = append(seq, b)
+		if len(seq) > 1 && b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	if k, ok := escapeKeys[string(seq)]; ok {
+		return k
+	}
+	return keyUnknown
+}
@@ -24,86 +24,139 @@ package main
 
 import (
 	"errors"
-	"flag"
 	"fmt"
-	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/Bowery/prompt"
 	"github.com/bndr/gotabulate"
 	"github.com/joliv/spark"
 
 	stdn "github.com/traetox/speedtest/speedtestdotnet"
-	"github.com/traetox/speedtest/version"
 	//stdn "./speedtestdotnet" //for testing
 )
 
 const (
 	tableFormat      = "simple"
-	maxFailureCount  = 3
 	initialTestCount = 5
 	basePingCount    = 5
 	fullTestCount    = 20
+	probeWorkers     = 4
+	probeDeadline    = 10 * time.Second
 )
 
 var (
-	speedtestDuration = flag.Int("t", 3, "Target duration for speedtests (in seconds)")
-	search            = flag.String("s", "", "Server name substring to search candidate servers")
-	auto              = flag.Bool("a", false, "Auto-select nearest candidate server")
-	interface_id      = flag.String("I", "", "Select which interface you would like to run the speed test on")
-	vrs               bool
+	speedtestDuration int
+	search            string
+	serverID          uint
+	auto              bool
+	interface_id      string
+	phases            = "latency,download,upload"
+	probeCandidates   int
+	healthPath        string
+	historyPath       string
+	noHistory         bool
+	userAgent         string
+	noHTTPFallback    bool
+	location          string
+	city              string
+	format            = formatText
+	csvHeaderFlag     = true
+	csvHeaderSet      bool
+	csvDelim          = ","
+	configURLs        stringList
+	serverURLs        stringList
+	health            *stdn.HealthStore
+	hist              *stdn.History
 )
 
-func init() {
-	flag.BoolVar(&vrs, "version", false, "print version and exit")
-	flag.BoolVar(&vrs, "v", false, "print version and exit (shorthand)")
-	flag.Parse()
-	if vrs {
-		fmt.Printf("Speedtest v%s\n", version.Version)
-		os.Exit(0)
+func main() {
+	name, args := defaultCommand, os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "-v", "-version", "--version":
+			runVersion(nil)
+			return
+		}
+		if !strings.HasPrefix(args[0], "-") {
+			name, args = args[0], args[1:]
+		}
 	}
-	if *speedtestDuration <= 0 {
-		fmt.Fprintf(os.Stderr, "Invalid test duration")
-		os.Exit(-1)
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitArgs)
 	}
+	cmd.run(args)
 }
 
-func main() {
-	cfg, err := stdn.GetConfig()
+// getConfig fetches the live configuration, falling back to the cached or built-in
+// server list when offline, and applies any location override
+func getConfig() *stdn.Config {
+	loc, override, err := locationOverride()
+	if err != nil {
+		fail(errCodeArgs, err)
+	}
+	cfg, err := newClient().GetConfig()
 	if err != nil {
-		fmt.Printf("Failed to get server list configuration: %v\n", err)
-		os.Exit(-1)
+		fmt.Fprintf(os.Stderr, "Failed to get server list configuration: %v\n", err)
+		if cfg, err = snapshotConfig(loc, override); err != nil {
+			fail(errCodeConfig, fmt.Errorf("Failed to use offline server list: %v", err))
+		}
+	} else {
+		cacheLocation(cfg)
+		if override {
+			if err = cfg.SetLocation(loc.Lat, loc.Long); err != nil {
+				fail(errCodeArgs, err)
+			}
+		}
 	}
 	if len(cfg.Servers) <= 0 {
-		fmt.Printf("No acceptable servers found\n")
-		os.Exit(-1)
+		fail(errCodeNoServers, errors.New("No acceptable servers found"))
 	}
+	return cfg
+}
+
+// candidateServers gathers the servers to choose from, either by probing the
+// closest servers or by searching, and shows them in a table
+func candidateServers(cfg *stdn.Config) []stdn.Testserver {
 	var headers []string
 	var data [][]string
 	var testServers []stdn.Testserver
-	if *search == "" {
-		fmt.Printf("Gathering server list and testing...\n")
-		if testServers, err = autoGetTestServers(cfg); err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
-			os.Exit(-1)
+	if serverID != 0 {
+		srv, err := getServerByID(cfg, serverID)
+		if err != nil {
+			fail(errCodeNoServers, err)
 		}
-		fmt.Printf("%d Closest responding servers:\n", len(testServers))
-		for i := range testServers {
+		return []stdn.Testserver{srv}
+	}
+	if search == "" {
+		statusf("Gathering server list and testing...\n")
+		probes, err := autoGetTestServers(cfg)
+		if err != nil {
+			fail(errCodeNoServers, err)
+		}
+		statusf("%d Best responding servers:\n", len(probes))
+		for i := range probes {
+			testServers = append(testServers, *probes[i].Server)
 			data = append(data, []string{fmt.Sprintf("%d", i),
-				testServers[i].Name, testServers[i].Sponsor,
-				fmt.Sprintf("%.02f", testServers[i].Distance),
-				fmt.Sprintf("%s", testServers[i].Latency)})
+				probes[i].Server.Name, probes[i].Server.Sponsor,
+				fmt.Sprintf("%.02f", probes[i].Server.Distance),
+				fmt.Sprintf("%s", probes[i].Latency),
+				fmt.Sprintf("%s", probes[i].Jitter),
+				fmt.Sprintf("%.0f%%", probes[i].Loss*100),
+				fmt.Sprintf("%.03f", probes[i].Score)})
 		}
-		headers = []string{"ID", "Name", "Sponsor", "Distance (km)", "Latency (ms)"}
+		headers = []string{"ID", "Name", "Sponsor", "Distance (km)", "Latency (ms)", "Jitter", "Loss", "Score"}
 	} else {
-		if testServers, err = getSearchServers(cfg, *search); err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
-			os.Exit(-1)
+		var err error
+		if testServers, err = getSearchServers(cfg, search); err != nil {
+			fail(errCodeNoServers, err)
 		}
 		headers = []string{"ID", "Name", "Sponsor", "Distance (km)"}
-		fmt.Printf("%d Matching servers:\n", len(testServers))
+		statusf("%d Matching servers:\n", len(testServers))
 		for i := range testServers {
 			data = append(data, []string{fmt.Sprintf("%d", i),
 				testServers[i].Name, testServers[i].Sponsor,
@@ -111,153 +164,273 @@ func main() {
 		}
 
 	}
-	t := gotabulate.Create(data)
-	t.SetHeaders(headers)
-	t.SetWrapStrings(false)
-	fmt.Printf("%s", t.Render(tableFormat))
-
-	// Define server variable to be used for either auto-selection or manual selection
-	var selServer stdn.Testserver
+	if textOutput() {
+		t := gotabulate.Create(data)
+		t.SetHeaders(headers)
+		t.SetWrapStrings(false)
+		fmt.Printf("%s", t.Render(tableFormat))
+	}
+	return testServers
+}
 
-	if *auto {
+// selectServer picks the server to test, automatically or by letting the user pick one
+func selectServer(cfg *stdn.Config, testServers []stdn.Testserver, tp stdn.TestPlan, interactive bool) stdn.Testserver {
+	//machine readable output cannot be interactive, so it always auto-selects
+	if len(testServers) == 1 || !interactive || !textOutput() {
 		// Double check the existence of a server again to avoid out-of bound panic
-		if len(testServers) > 0 {
-			selServer = testServers[0]
-		} else {
-			fmt.Println("No servers found")
-			os.Exit(-1)
+		if len(testServers) == 0 {
+			fail(errCodeNoServers, errors.New("No servers found"))
 		}
-		fmt.Printf("\nAuto-selecting closest server for bandwidth test: %s / %s\n", selServer.Name, selServer.Sponsor)
-	} else {
-		fmt.Printf("Enter server ID for bandwidth test, or \"quit\" to exit\n")
-		for {
-			s, err := prompt.Basic("ID> ", true)
-			if err != nil {
-				fmt.Printf("input failure \"%v\"\n", err)
-				os.Exit(-1)
-			}
-			//be REALLY forgiving on exit logic
-			if strings.HasPrefix(strings.ToLower(s), "exit") {
-				os.Exit(0)
-			}
-			if strings.HasPrefix(strings.ToLower(s), "quit") {
-				os.Exit(0)
-			}
+		selServer := testServers[0]
+		statusf("\nAuto-selecting best scoring server for bandwidth test: %s / %s\n", selServer.Name, selServer.Sponsor)
+		return selServer
+	}
+	return pickServer(cfg, testServers, tp)
+}
 
-			//try to convert the string to a number
-			id, err := strconv.ParseUint(s, 10, 64)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "\"%s\" is not a valid id\n", s)
-				continue
-			}
-			if id > uint64(len(testServers)) {
-				fmt.Fprintf(os.Stderr, "No server with ID \"%d\" available\n", id)
-				continue
-			}
+// testPlan builds the test plan from the command line options
+func testPlan() (stdn.TestPlan, error) {
+	tp := stdn.NewTestPlan()
+	tp.PingCount = fullTestCount
+	tp.Duration = speedtestDuration
+	tp.Interface = interface_id
+	if err := tp.ParsePhases(phases); err != nil {
+		return tp, err
+	}
+	if len(tp.Phases()) == 0 {
+		return tp, errors.New("No test phases selected")
+	}
+	return tp, nil
+}
 
-			// We are done, set ID accordingly
-			selServer = testServers[id]
-			break
-		}
+// fullTest runs each phase of the plan, printing the outcome of each phase as it completes
+// with live progress during the bandwidth tests
+func fullTest(cfg *stdn.Config, server stdn.Testserver, tp stdn.TestPlan) (*stdn.Result, error) {
+	if !textOutput() {
+		return server.Run(tp)
+	}
+	g := newGauge()
+	if !noProgress {
+		tp.Progress = g.update
 	}
+	tp.Report = func(p stdn.Phase, res *stdn.Result) {
+		g.clear()
+		printPhase(cfg, p, res)
+	}
+	res, err := server.Run(tp)
+	g.clear()
+	return res, err
+}
 
-	// Perform the actual test
-	if err = fullTest(selServer); err != nil {
-		switch err {
-		case io.EOF:
-			fmt.Fprintf(os.Stderr, "Error, the remote server kicked us.\n")
-			fmt.Fprintf(os.Stderr, "Maximum request size may have changed\n")
-		case stdn.ErrTimeout:
-			fmt.Fprintf(os.Stderr, "Test failed due to connection timeout.  The server may be down, or rejecting us")
-		default:
-			fmt.Fprintf(os.Stderr, "Test failed with unknown error: %v\n", err)
+// printPhase prints the human readable outcome of a completed phase
+func printPhase(cfg *stdn.Config, p stdn.Phase, res *stdn.Result) {
+	switch p {
+	case stdn.PhaseLatency:
+		ls := res.Latency
+		var latencies []float64
+		for i := range ls.Samples {
+			latencies = append(latencies, float64(ls.Samples[i].Milliseconds()))
 		}
-		os.Exit(-1)
+		sparkline := spark.Line(latencies)
+		fmt.Printf("Latency: %s\t%dms avg\t%dms median\t%dms max\t%dms min\n", sparkline,
+			ls.Avg.Milliseconds(), ls.Median.Milliseconds(), ls.Max.Milliseconds(), ls.Min.Milliseconds())
+	case stdn.PhaseDownload:
+		fmt.Printf("Download: %s%s\n", humanSpeed(res.Download.Bps), ispCompare(res.Download.Bps, cfg.ISPDlAvg))
+	case stdn.PhaseUpload:
+		fmt.Printf("Upload:   %s%s\n", humanSpeed(res.Upload.Bps), ispCompare(res.Upload.Bps, cfg.ISPUpAvg))
 	}
 }
 
-func testLatency(server stdn.Testserver) error {
-	//perform a full latency test
-	durs, err := server.Ping(fullTestCount)
-	if err != nil {
-		return err
-	}
-	var avg, max, min uint64
-	var latencies []float64
-	for i := range durs {
-		ms := uint64(durs[i].Nanoseconds() / 1000000)
-		latencies = append(latencies, float64(ms))
-		avg += ms
-		if ms > max {
-			max = ms
+// ispCompare describes how a measured speed compares with the ISP average
+func ispCompare(bps, avg uint64) string {
+	if avg == 0 {
+		return ""
+	}
+	r := float64(bps) / float64(avg)
+	return fmt.Sprintf("\t(%.02fx ISP average of %s)", r, humanSpeed(avg))
+}
+
+// newClient builds a configuration client from the command line options
+func newClient() *stdn.Client {
+	clnt := stdn.NewClient()
+	if len(configURLs) > 0 {
+		clnt.ConfigURLs = configURLs
+	}
+	if len(serverURLs) > 0 {
+		clnt.ServerURLs = serverURLs
+	}
+	clnt.UserAgent = userAgent
+	clnt.HTTPFallback = !noHTTPFallback
+	return clnt
+}
+
+// locationOverride returns the client location given on the command line, if any
+func locationOverride() (loc stdn.Location, ok bool, err error) {
+	switch {
+	case location != "" && city != "":
+		err = errors.New("-location and -city are mutually exclusive")
+	case location != "":
+		loc.Lat, loc.Long, err = parseLocation(location)
+		ok = err == nil
+	case city != "":
+		loc.Lat, loc.Long, err = stdn.LookupCity(city)
+		ok = err == nil
+	}
+	return
+}
+
+// snapshotConfig builds a configuration from the cached server list, or the
+// built-in one, using the location from the command line or the last known location
+func snapshotConfig(loc stdn.Location, override bool) (*stdn.Config, error) {
+	if !override {
+		path, err := stdn.DefaultLocationCachePath()
+		if err != nil {
+			return nil, err
 		}
-		if ms < min || min == 0 {
-			min = ms
+		if loc, err = stdn.LoadLocation(path); err != nil {
+			return nil, fmt.Errorf("no known location, use -location or -city: %v", err)
 		}
 	}
-	avg = avg / uint64(len(durs))
-	median := durs[len(durs)/2].Nanoseconds() / 1000000
-	sparkline := spark.Line(latencies)
-	fmt.Printf("Latency: %s\t%dms avg\t%dms median\t%dms max\t%dms min\n", sparkline, avg, median, max, min)
-	return nil
+	if path, err := stdn.DefaultServerCachePath(); err == nil {
+		if srvs, err := stdn.LoadServerList(path); err == nil {
+			fmt.Fprintf(os.Stderr, "Using cached server list\n")
+			return stdn.NewConfig(loc, srvs)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Using built-in server list\n")
+	return stdn.SnapshotConfig(loc)
 }
 
-func testDownstream(server stdn.Testserver) error {
-	bps, err := server.Downstream(*speedtestDuration, *interface_id)
+// cacheLocation remembers our location for the next time we are offline
+func cacheLocation(cfg *stdn.Config) {
+	path, err := stdn.DefaultLocationCachePath()
 	if err != nil {
-		return err
+		return
 	}
-	fmt.Printf("Download: %s\n", stdn.HumanSpeed(bps))
-	return nil
+	if err := stdn.SaveLocation(path, cfg.Location()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to cache location: %v\n", err)
+	}
+}
+
+// parseLocation parses a "lat,lon" pair
+func parseLocation(v string) (lat, long float64, err error) {
+	flds := strings.Split(v, ",")
+	if len(flds) != 2 {
+		err = fmt.Errorf("invalid location %q, expected \"lat,lon\"", v)
+		return
+	}
+	if lat, err = strconv.ParseFloat(strings.TrimSpace(flds[0]), 64); err != nil {
+		return
+	}
+	if long, err = strconv.ParseFloat(strings.TrimSpace(flds[1]), 64); err != nil {
+		return
+	}
+	if lat < -90 || lat > 90 || long < -180 || long > 180 {
+		err = fmt.Errorf("location %q is out of range", v)
+	}
+	return
 }
 
-func testUpstream(server stdn.Testserver) error {
-	bps, err := server.Upstream(*speedtestDuration, *interface_id)
+// openHealthStore opens the server health store, a broken store is reported and ignored
+func openHealthStore(path string) *stdn.HealthStore {
+	if path == "" {
+		var err error
+		if path, err = stdn.DefaultHealthStorePath(); err != nil {
+			fmt.Fprintf(os.Stderr, "Server health history disabled: %v\n", err)
+			return nil
+		}
+	}
+	hs, err := stdn.OpenHealthStore(path)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "Server health history disabled: %v\n", err)
+		return nil
 	}
-	fmt.Printf("Upload:   %s\n", stdn.HumanSpeed(bps))
-	return nil
+	return hs
 }
 
-func fullTest(server stdn.Testserver) error {
-	if err := testLatency(server); err != nil {
-		return err
+// openHistory opens the result history unless it was disabled
+func openHistory() *stdn.History {
+	if noHistory {
+		return nil
+	}
+	path := historyPath
+	if path == "" {
+		var err error
+		if path, err = stdn.DefaultHistoryPath(); err != nil {
+			fmt.Fprintf(os.Stderr, "Result history disabled: %v\n", err)
+			return nil
+		}
 	}
-	if err := testDownstream(server); err != nil {
-		return err
+	return stdn.NewHistory(path)
+}
+
+// recordResult saves a test outcome to the server health store, result history and sinks,
+// then evaluates the alert rules against the updated history
+func recordResult(cfg *stdn.Config, res *stdn.Result, err error) {
+	if herr := hist.Append(stdn.NewHistoryEntry(cfg, res, err)); herr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save result history: %v\n", herr)
 	}
-	if err := testUpstream(server); err != nil {
-		return err
+	evaluateAlerts(res)
+	if err == nil {
+		sinkResult(res)
 	}
-	return nil
+	recordHealth(res, err)
 }
 
-func autoGetTestServers(cfg *stdn.Config) ([]stdn.Testserver, error) {
-	//get the first 5 closest servers
-	testServers := []stdn.Testserver{}
-	failures := 0
-	for i := range cfg.Servers {
-		if failures >= maxFailureCount {
-			if len(testServers) > 0 {
-				return testServers, nil
-			}
-			return nil, fmt.Errorf("Failed to perform latency test on closest servers\n")
-		}
-		if len(testServers) >= initialTestCount {
-			return testServers, nil
+// recordHealth updates and saves the server health store with a test outcome
+func recordHealth(res *stdn.Result, err error) {
+	if err := updateHealth(res, err); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save server health history: %v\n", err)
+	}
+}
+
+// updateHealth updates the server health store with a test outcome and saves it
+func updateHealth(res *stdn.Result, err error) error {
+	if health == nil {
+		return nil
+	}
+	if err != nil {
+		health.RecordFailure(res.Server.ID, err)
+	} else if res.Download != nil || res.Upload != nil {
+		var dl, ul uint64
+		if res.Download != nil {
+			dl = res.Download.Bps
 		}
-		//get a latency from the server, the last latency will also be store in the
-		//server structure
-		if _, err := cfg.Servers[i].MedianPing(basePingCount); err != nil {
-			failures++
-			continue
+		if res.Upload != nil {
+			ul = res.Upload.Bps
 		}
-		testServers = append(testServers, cfg.Servers[i])
+		health.RecordSuccess(res.Server.ID, dl, ul)
+	}
+	return health.Save()
+}
+
+func autoGetTestServers(cfg *stdn.Config) ([]stdn.ProbeResult, error) {
+	//probe the closest servers concurrently and keep the best scoring responders
+	probes := stdn.ProbeServers(cfg.Servers, stdn.ProbeConfig{
+		Candidates: probeCandidates,
+		Workers:    probeWorkers,
+		Count:      basePingCount,
+		Deadline:   probeDeadline,
+	})
+	testServers := stdn.RankServers(probes, health, stdn.DefaultScoreWeights)
+	if len(testServers) == 0 {
+		return nil, errors.New("Failed to perform latency test on closest servers")
+	}
+	if len(testServers) > initialTestCount {
+		testServers = testServers[:initialTestCount]
 	}
 	return testServers, nil
 }
 
+func getServerByID(cfg *stdn.Config, id uint) (stdn.Testserver, error) {
+	for i := range cfg.Servers {
+		if cfg.Servers[i].ID == id {
+			return cfg.Servers[i], nil
+		}
+	}
+	return stdn.Testserver{}, fmt.Errorf("no server with ID %d", id)
+}
+
 func getSearchServers(cfg *stdn.Config, query string) ([]stdn.Testserver, error) {
 	//get the first 5 closest servers
 	testServers := []stdn.Testserver{}
@@ -271,3 +444,19 @@ func getSearchServers(cfg *stdn.Config, query string) ([]stdn.Testserver, error)
 	}
 	return testServers, nil
 }
+
+// stringList is a flag which may be repeated or given a comma separated list
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*sl = append(*sl, s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const formatNagios = "nagios"
+
+// plugin states and their exit codes as defined by the Nagios plugin guidelines
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+var (
+	nagiosStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+	nagiosMode bool
+	nagiosWarn thresholds
+	nagiosCrit thresholds
+)
+
+func addNagiosFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&nagiosMode, "nagios", false, "Run as a Nagios or Icinga plugin, shorthand for -format nagios")
+	fs.Var(&nagiosWarn.minDownload, "warning-download", "As a plugin, warn if the download speed is below this")
+	fs.Var(&nagiosCrit.minDownload, "critical-download", "As a plugin, critical if the download speed is below this")
+	fs.Var(&nagiosWarn.minUpload, "warning-upload", "As a plugin, warn if the upload speed is below this")
+	fs.Var(&nagiosCrit.minUpload, "critical-upload", "As a plugin, critical if the upload speed is below this")
+	fs.DurationVar(&nagiosWarn.maxLatency, "warning-latency", 0, "As a plugin, warn if the median latency is above this")
+	fs.DurationVar(&nagiosCrit.maxLatency, "critical-latency", 0, "As a plugin, critical if the median latency is above this")
+}
+
+// validateNagios ensures the plugin thresholds are only used as a plugin and apply to the plan
+func validateNagios(tp stdn.TestPlan) error {
+	if format != formatNagios {
+		if nagiosWarn != (thresholds{}) || nagiosCrit != (thresholds{}) {
+			return errors.New("-warning-* and -critical-* thresholds require -format nagios")
+		}
+		return nil
+	}
+	if limits != (thresholds{}) {
+		return errors.New("Use the -warning-* and -critical-* thresholds with -format nagios")
+	}
+	if err := nagiosWarn.validate(tp); err != nil {
+		return err
+	}
+	return nagiosCrit.validate(tp)
+}
+
+// nagiosState maps an error code to the plugin state.  A timeout means the link
+// could not carry a test, anything else says nothing about the link itself.
+func nagiosState(code string) int {
+	if code == errCodeTimeout {
+		return nagiosCritical
+	}
+	return nagiosUnknown
+}
+
+// nagiosFail reports an error as a plugin status line and exits
+func nagiosFail(code string, err error) {
+	nagiosExit(nagiosState(code), strings.Replace(err.Error(), "\n", " ", -1), "")
+}
+
+// nagiosReport reports a completed test as a plugin status line with perfdata and exits
+func nagiosReport(res *stdn.Result) {
+	state := nagiosOK
+	msgs := nagiosCrit.check(res)
+	if len(msgs) > 0 {
+		state = nagiosCritical
+	} else if msgs = nagiosWarn.check(res); len(msgs) > 0 {
+		state = nagiosWarning
+	}
+	var summary []string
+	var perf []string
+	if ls := res.Latency; ls != nil {
+		summary = append(summary, fmt.Sprintf("Latency %.02fms", ms(ls.Median)))
+		perf = append(perf, fmt.Sprintf("latency=%.03fms;%s;%s;0;", ms(ls.Median),
+			perfLatency(nagiosWarn.maxLatency), perfLatency(nagiosCrit.maxLatency)))
+		perf = append(perf, fmt.Sprintf("jitter=%.03fms;;;0;", ms(ls.Jitter)))
+	}
+	if res.Download != nil {
+		summary = append(summary, "Download "+humanSpeed(res.Download.Bps))
+		perf = append(perf, fmt.Sprintf("download=%dbps;%s;%s;0;", res.Download.Bps,
+			perfSpeed(nagiosWarn.minDownload), perfSpeed(nagiosCrit.minDownload)))
+	}
+	if res.Upload != nil {
+		summary = append(summary, "Upload "+humanSpeed(res.Upload.Bps))
+		perf = append(perf, fmt.Sprintf("upload=%dbps;%s;%s;0;", res.Upload.Bps,
+			perfSpeed(nagiosWarn.minUpload), perfSpeed(nagiosCrit.minUpload)))
+	}
+	text := strings.Join(summary, ", ")
+	if len(msgs) > 0 {
+		text = strings.Join(msgs, ", ")
+	}
+	text += fmt.Sprintf(" (server %d %s)", res.Server.ID, res.Server.Sponsor)
+	nagiosExit(state, text, strings.Join(perf, " "))
+}
+
+// perfSpeed formats a minimum speed as a perfdata range, alerting when the value is below it
+func perfSpeed(s speed) string {
+	if s == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:", uint64(s))
+}
+
+func perfLatency(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.03f", ms(d))
+}
+
+func nagiosExit(state int, text, perf string) {
+	line := fmt.Sprintf("SPEEDTEST %s - %s", nagiosStates[state], text)
+	if perf != "" {
+		line += " | " + perf
+	}
+	fmt.Println(line)
+	os.Exit(state)
+}
@@ -0,0 +1,373 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+	"github.com/traetox/speedtest/version"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// csvHeader is the documented CSV column layout, append new columns to the end only
+var csvHeader = []string{
+	"timestamp",
+	"server_id",
+	"sponsor",
+	"server_name",
+	"distance_km",
+	"latency_min_ms",
+	"latency_avg_ms",
+	"latency_median_ms",
+	"latency_max_ms",
+	"latency_jitter_ms",
+	"download_bps",
+	"upload_bps",
+	"phases",
+}
+
+// error codes reported in machine readable output, these must remain stable
+const (
+	errCodeArgs       = "invalid_arguments"
+	errCodeConfig     = "config_unavailable"
+	errCodeNoServers  = "no_servers"
+	errCodeInput      = "input_failure"
+	errCodeTimeout    = "timeout"
+	errCodeDisconnect = "server_disconnected"
+	errCodeTest       = "test_failed"
+	errCodeThreshold  = "threshold_failed"
+	errCodeOutput     = "output_failed"
+)
+
+// process exit codes for each class of failure, these must remain stable
+const (
+	exitOK         = 0
+	exitThreshold  = 1 //the test completed but missed a -min or -max threshold
+	exitArgs       = 2 //matches the flag package on a flag parsing error
+	exitConfig     = 3
+	exitNoServers  = 4
+	exitInput      = 5
+	exitTimeout    = 6
+	exitDisconnect = 7
+	exitTest       = 8
+	exitOutput     = 9
+)
+
+var exitCodes = map[string]int{
+	errCodeArgs:       exitArgs,
+	errCodeConfig:     exitConfig,
+	errCodeNoServers:  exitNoServers,
+	errCodeInput:      exitInput,
+	errCodeTimeout:    exitTimeout,
+	errCodeDisconnect: exitDisconnect,
+	errCodeTest:       exitTest,
+	errCodeThreshold:  exitThreshold,
+	errCodeOutput:     exitOutput,
+}
+
+type jsonResult struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Finished  time.Time     `json:"finished"`
+	Duration  float64       `json:"duration_seconds"`
+	Interface string        `json:"interface,omitempty"`
+	Phases    []stdn.Phase  `json:"phases"`
+	Client    jsonClient    `json:"client"`
+	Server    jsonServer    `json:"server"`
+	Latency   *jsonLatency  `json:"latency,omitempty"`
+	Download  *jsonTransfer `json:"download,omitempty"`
+	Upload    *jsonTransfer `json:"upload,omitempty"`
+	Version   string        `json:"version"`
+}
+
+type jsonClient struct {
+	IP       string  `json:"ip"`
+	ISP      string  `json:"isp"`
+	Lat      float64 `json:"lat"`
+	Long     float64 `json:"lon"`
+	ISPDlAvg uint64  `json:"isp_download_avg_bps,omitempty"`
+	ISPUpAvg uint64  `json:"isp_upload_avg_bps,omitempty"`
+}
+
+type jsonServer struct {
+	ID       uint    `json:"id"`
+	Name     string  `json:"name"`
+	Sponsor  string  `json:"sponsor"`
+	Country  string  `json:"country"`
+	CC       string  `json:"cc,omitempty"`
+	Host     string  `json:"host"`
+	Lat      float64 `json:"lat"`
+	Long     float64 `json:"lon"`
+	Distance float64 `json:"distance_km"`
+}
+
+type jsonLatency struct {
+	Samples []float64 `json:"samples_ms"`
+	Min     float64   `json:"min_ms"`
+	Max     float64   `json:"max_ms"`
+	Avg     float64   `json:"avg_ms"`
+	Median  float64   `json:"median_ms"`
+	Jitter  float64   `json:"jitter_ms"`
+}
+
+type jsonTransfer struct {
+	Bps      uint64  `json:"bps"`
+	Bytes    uint64  `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+type jsonError struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Error     jsonErrorDetail `json:"error"`
+}
+
+type jsonErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func validFormat(f string) bool {
+	switch f {
+	case formatText, formatJSON, formatCSV, formatInflux, formatNagios:
+		return true
+	}
+	return compatFormat(f)
+}
+
+func textOutput() bool {
+	return format == formatText
+}
+
+// statusf prints human oriented progress, which is suppressed for machine readable output
+func statusf(f string, args ...interface{}) {
+	if textOutput() {
+		fmt.Printf(f, args...)
+	}
+}
+
+// writeResult writes the final result, text output was already printed as the test ran
+func writeResult(cfg *stdn.Config, res *stdn.Result) error {
+	switch format {
+	case formatJSON:
+		return writeJSON(os.Stdout, newJSONResult(cfg, res))
+	case formatCSV:
+		return writeCSV(os.Stdout, []*stdn.Result{res}, csvHeaderFlag)
+	case formatInflux:
+		return writeInflux(os.Stdout, res)
+	}
+	return writeCompatResult(os.Stdout, cfg, res)
+}
+
+// fail reports an error in the selected output format and exits
+func fail(code string, err error) {
+	if format == formatNagios {
+		nagiosFail(code, err)
+	}
+	if format == formatJSON {
+		writeJSON(os.Stdout, jsonError{
+			Timestamp: time.Now(),
+			Error:     jsonErrorDetail{Code: code, Message: err.Error()},
+		})
+	} else {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	exit(code)
+}
+
+// exit terminates with the exit code of an error code
+func exit(code string) {
+	if ec, ok := exitCodes[code]; ok {
+		os.Exit(ec)
+	}
+	os.Exit(exitTest)
+}
+
+// testFailed explains why a bandwidth test failed and exits
+func testFailed(err error) {
+	fail(testError(err))
+}
+
+// testError classifies a test failure and explains it
+func testError(err error) (string, error) {
+	switch err {
+	case io.EOF:
+		return errCodeDisconnect, fmt.Errorf("Error, the remote server kicked us.\nMaximum request size may have changed")
+	case stdn.ErrTimeout:
+		return errCodeTimeout, fmt.Errorf("Test failed due to connection timeout.  The server may be down, or rejecting us")
+	case stdn.ErrCanceled:
+		return errCodeTest, fmt.Errorf("Test canceled")
+	}
+	return errCodeTest, fmt.Errorf("Test failed with unknown error: %v", err)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// csvDelimiter returns the single character CSV delimiter from the command line
+func csvDelimiter() (rune, error) {
+	r, sz := utf8.DecodeRuneInString(csvDelim)
+	if sz == 0 || sz != len(csvDelim) || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("Invalid CSV delimiter %q", csvDelim)
+	}
+	return r, nil
+}
+
+// writeCSV writes one row per result, optionally preceded by the header
+func writeCSV(w io.Writer, results []*stdn.Result, header bool) error {
+	delim, err := csvDelimiter()
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	if header {
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	for _, res := range results {
+		if err := cw.Write(csvRecord(res)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvRecord(res *stdn.Result) []string {
+	rec := []string{
+		res.Start.UTC().Format(time.RFC3339),
+		strconv.FormatUint(uint64(res.Server.ID), 10),
+		res.Server.Sponsor,
+		res.Server.Name,
+		strconv.FormatFloat(res.Server.Distance, 'f', 2, 64),
+	}
+	if ls := res.Latency; ls != nil {
+		for _, d := range []time.Duration{ls.Min, ls.Avg, ls.Median, ls.Max, ls.Jitter} {
+			rec = append(rec, strconv.FormatFloat(ms(d), 'f', 3, 64))
+		}
+	} else {
+		rec = append(rec, "", "", "", "", "")
+	}
+	rec = append(rec, csvBps(res.Download), csvBps(res.Upload), csvPhases(res))
+	return rec
+}
+
+func csvBps(xfer *stdn.Transfer) string {
+	if xfer == nil {
+		return ""
+	}
+	return strconv.FormatUint(xfer.Bps, 10)
+}
+
+// csvPhases lists the phases which ran separated by semicolons
+func csvPhases(res *stdn.Result) string {
+	var ps []string
+	for _, p := range res.Phases() {
+		ps = append(ps, string(p))
+	}
+	return strings.Join(ps, ";")
+}
+
+func newJSONResult(cfg *stdn.Config, res *stdn.Result) jsonResult {
+	jr := jsonResult{
+		Timestamp: res.Start.UTC(),
+		Finished:  res.End.UTC(),
+		Duration:  res.End.Sub(res.Start).Seconds(),
+		Interface: res.Interface,
+		Phases:    res.Phases(),
+		Client: jsonClient{
+			ISP:      cfg.ISP,
+			Lat:      cfg.Lat,
+			Long:     cfg.Long,
+			ISPDlAvg: cfg.ISPDlAvg,
+			ISPUpAvg: cfg.ISPUpAvg,
+		},
+		Server:  newJSONServer(res.Server),
+		Version: version.Version,
+	}
+	if cfg.IP != nil {
+		jr.Client.IP = cfg.IP.String()
+	}
+	if ls := res.Latency; ls != nil {
+		jr.Latency = &jsonLatency{
+			Min:    ms(ls.Min),
+			Max:    ms(ls.Max),
+			Avg:    ms(ls.Avg),
+			Median: ms(ls.Median),
+			Jitter: ms(ls.Jitter),
+		}
+		for _, d := range ls.Samples {
+			jr.Latency.Samples = append(jr.Latency.Samples, ms(d))
+		}
+	}
+	jr.Download = newJSONTransfer(res.Download)
+	jr.Upload = newJSONTransfer(res.Upload)
+	return jr
+}
+
+func newJSONServer(srv stdn.Testserver) jsonServer {
+	return jsonServer{
+		ID:       srv.ID,
+		Name:     srv.Name,
+		Sponsor:  srv.Sponsor,
+		Country:  srv.Country,
+		CC:       srv.CC,
+		Host:     srv.Host,
+		Lat:      srv.Lat,
+		Long:     srv.Long,
+		Distance: srv.Distance,
+	}
+}
+
+func newJSONTransfer(xfer *stdn.Transfer) *jsonTransfer {
+	if xfer == nil {
+		return nil
+	}
+	return &jsonTransfer{
+		Bps:      xfer.Bps,
+		Bytes:    xfer.Bytes,
+		Duration: xfer.Duration.Seconds(),
+	}
+}
+
+// ms converts a duration to fractional milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
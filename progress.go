@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Bowery/prompt"
+	"github.com/joliv/spark"
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	plainProgressInterval = time.Second //time between progress lines when stdout is not a terminal
+	maxGaugeSpark         = 40          //most recent rate samples drawn in the gauge
+	defaultGaugeWidth     = 80
+	clearLine             = "\r\033[K"
+)
+
+var noProgress bool
+
+func addProgressFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&noProgress, "no-progress", false, "Do not show live progress during the download and upload tests")
+}
+
+// gauge shows bandwidth test progress, redrawn in place on a terminal and
+// as periodic plain lines otherwise
+type gauge struct {
+	out   io.Writer
+	tty   bool
+	width int
+	rates []float64
+	next  time.Duration //elapsed time of the next plain line
+	drawn bool
+}
+
+func newGauge() *gauge {
+	w, _, err := prompt.TerminalSize(os.Stdout)
+	if err != nil {
+		return &gauge{out: os.Stdout, next: plainProgressInterval}
+	}
+	if w <= 0 {
+		w = defaultGaugeWidth
+	}
+	return &gauge{
+		out:   prompt.NewAnsiWriter(os.Stdout),
+		tty:   true,
+		width: w,
+	}
+}
+
+// update draws the latest progress report
+func (g *gauge) update(p stdn.Progress) {
+	g.rates = append(g.rates, float64(p.Bps))
+	line := fmt.Sprintf("%s %s  %.1fs  %s", phaseLabel(p.Phase), humanSpeed(p.Bps),
+		p.Elapsed.Seconds(), units.Size(p.Bytes))
+	if !g.tty {
+		if p.Elapsed < g.next {
+			return
+		}
+		g.next = p.Elapsed + plainProgressInterval
+		fmt.Fprintln(g.out, line)
+		return
+	}
+	//the spark line grows to fill whatever the text leaves, the cursor stays off the last column
+	if room := g.width - utf8.RuneCountInString(line) - 3; room > 0 {
+		if room > maxGaugeSpark {
+			room = maxGaugeSpark
+		}
+		rates := g.rates
+		if len(rates) > room {
+			rates = rates[len(rates)-room:]
+		}
+		line += "  " + spark.Line(rates)
+	} else if len(line) >= g.width {
+		line = line[:g.width-1]
+	}
+	fmt.Fprint(g.out, clearLine+line)
+	g.drawn = true
+}
+
+// clear removes the gauge so the final result can be printed, and resets it for the next phase
+func (g *gauge) clear() {
+	if g.drawn {
+		fmt.Fprint(g.out, clearLine)
+		g.drawn = false
+	}
+	g.rates = nil
+	if !g.tty {
+		g.next = plainProgressInterval
+	}
+}
+
+func phaseLabel(p stdn.Phase) string {
+	if p == stdn.PhaseUpload {
+		return "Upload:  "
+	}
+	return "Download:"
+}
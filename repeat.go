@@ -0,0 +1,246 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/bndr/gotabulate"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// run is the outcome of a single test in repeat mode
+type run struct {
+	res *stdn.Result
+	err error
+}
+
+// stat summarizes a single metric across runs
+type stat struct {
+	Min    float64 `json:"min"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Max    float64 `json:"max"`
+	N      int     `json:"samples"`
+}
+
+type jsonSummary struct {
+	Runs     int   `json:"runs"`
+	Failures int   `json:"failures"`
+	Latency  *stat `json:"latency_ms,omitempty"`
+	Jitter   *stat `json:"jitter_ms,omitempty"`
+	Download *stat `json:"download_bps,omitempty"`
+	Upload   *stat `json:"upload_bps,omitempty"`
+}
+
+type jsonRepeat struct {
+	Results []jsonResult `json:"results"`
+	Errors  []jsonError  `json:"errors,omitempty"`
+	Summary jsonSummary  `json:"summary"`
+}
+
+// repeatTest runs the test plan count times, rotating through the servers if more
+// than one is given, and finishes with a summary of all the runs.
+// An interrupt stops the runs early, after the current run completes.
+func repeatTest(cfg *stdn.Config, servers []stdn.Testserver, tp stdn.TestPlan, count int, interval time.Duration) {
+	var runs []run
+	var lastErr error
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	defer signal.Stop(intr)
+
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		srv := servers[i%len(servers)]
+		statusf("\nRun %d of %d: %s / %s\n", i+1, count, srv.Name, srv.Sponsor)
+		res, err := fullTest(cfg, srv, tp)
+		recordResult(cfg, res, err)
+		runs = append(runs, run{res: res, err: err})
+		if err != nil {
+			lastErr = err
+			_, msg := testError(err)
+			fmt.Fprintf(os.Stderr, "Run %d failed: %v\n", i+1, msg)
+		} else if format != formatText && format != formatJSON {
+			if err = writeResult(cfg, res); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+				os.Exit(exitOutput)
+			}
+			//only the first row gets a header so the output is a single table
+			csvHeaderFlag = false
+		}
+		if i == count-1 {
+			break
+		}
+		select {
+		case <-intr:
+			fmt.Fprintf(os.Stderr, "Interrupted after %d of %d runs\n", i+1, count)
+			i = count
+		case <-time.After(time.Until(start.Add(interval))):
+		}
+	}
+
+	sum := summarize(runs)
+	switch format {
+	case formatText:
+		printRuns(runs)
+		printSummary(sum)
+	case formatJSON:
+		jr := jsonRepeat{Summary: sum}
+		for _, r := range runs {
+			if r.err != nil {
+				code, msg := testError(r.err)
+				jr.Errors = append(jr.Errors, jsonError{
+					Timestamp: r.res.Start.UTC(),
+					Error:     jsonErrorDetail{Code: code, Message: msg.Error()},
+				})
+			} else {
+				jr.Results = append(jr.Results, newJSONResult(cfg, r.res))
+			}
+		}
+		if err := writeJSON(os.Stdout, jr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+			os.Exit(exitOutput)
+		}
+	}
+
+	if lastErr != nil {
+		code, _ := testError(lastErr)
+		exit(code)
+	}
+	for _, r := range runs {
+		checkThresholds(r.res)
+	}
+}
+
+// summarize gathers the statistics of every successful run
+func summarize(runs []run) (sum jsonSummary) {
+	var lat, jit, dl, ul []float64
+	for _, r := range runs {
+		sum.Runs++
+		if r.err != nil {
+			sum.Failures++
+			continue
+		}
+		if ls := r.res.Latency; ls != nil {
+			lat = append(lat, ms(ls.Median))
+			jit = append(jit, ms(ls.Jitter))
+		}
+		if r.res.Download != nil {
+			dl = append(dl, float64(r.res.Download.Bps))
+		}
+		if r.res.Upload != nil {
+			ul = append(ul, float64(r.res.Upload.Bps))
+		}
+	}
+	sum.Latency = newStat(lat)
+	sum.Jitter = newStat(jit)
+	sum.Download = newStat(dl)
+	sum.Upload = newStat(ul)
+	return
+}
+
+func newStat(vals []float64) *stat {
+	if len(vals) == 0 {
+		return nil
+	}
+	s := make([]float64, len(vals))
+	copy(s, vals)
+	sort.Float64s(s)
+	st := &stat{
+		Min: s[0],
+		Max: s[len(s)-1],
+		N:   len(s),
+	}
+	for _, v := range s {
+		st.Mean += v
+	}
+	st.Mean /= float64(len(s))
+	if len(s)%2 == 0 {
+		st.Median = (s[len(s)/2-1] + s[len(s)/2]) / 2
+	} else {
+		st.Median = s[len(s)/2]
+	}
+	return st
+}
+
+func printRuns(runs []run) {
+	var data [][]string
+	for i, r := range runs {
+		row := []string{fmt.Sprintf("%d", i+1), r.res.Start.Format("15:04:05"),
+			fmt.Sprintf("%d", r.res.Server.ID), r.res.Server.Sponsor}
+		if r.err != nil {
+			_, msg := testError(r.err)
+			row = append(row, "failed", msg.Error(), "")
+		} else {
+			row = append(row, latencyCell(r.res.Latency), speedCell(r.res.Download), speedCell(r.res.Upload))
+		}
+		data = append(data, row)
+	}
+	fmt.Printf("\n")
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"Run", "Time", "Server", "Sponsor", "Latency", "Download", "Upload"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+}
+
+func printSummary(sum jsonSummary) {
+	fmt.Printf("%d runs, %d failed\n", sum.Runs, sum.Failures)
+	var data [][]string
+	addRow := func(name string, st *stat, f func(float64) string) {
+		if st != nil {
+			data = append(data, []string{name, f(st.Min), f(st.Mean), f(st.Median), f(st.Max)})
+		}
+	}
+	msCell := func(v float64) string { return fmt.Sprintf("%.02fms", v) }
+	bpsCell := func(v float64) string { return humanSpeed(uint64(v)) }
+	addRow("Latency", sum.Latency, msCell)
+	addRow("Jitter", sum.Jitter, msCell)
+	addRow("Download", sum.Download, bpsCell)
+	addRow("Upload", sum.Upload, bpsCell)
+	if len(data) == 0 {
+		return
+	}
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"", "Min", "Mean", "Median", "Max"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+}
+
+func latencyCell(ls *stdn.LatencyStats) string {
+	if ls == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.02fms", ms(ls.Median))
+}
+
+func speedCell(xfer *stdn.Transfer) string {
+	if xfer == nil {
+		return "-"
+	}
+	return humanSpeed(xfer.Bps)
+}
@@ -0,0 +1,588 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Bowery/prompt"
+	"github.com/bndr/gotabulate"
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	replPrompt      = "speedtest> "
+	maxReplHistory  = 500
+	maxCompletions  = 40 //most completion candidates listed at once
+	replIntro       = "Type \"help\" for commands, \"test <id>\" to test a server from the list, or \"quit\" to exit\n"
+	replPickIntro   = "Type \"help\" for commands, \"test <id>\" to start the runs on a server, or \"quit\" to exit\n"
+	replNeedsServer = "%s needs a server ID from the list"
+)
+
+// replCommand is a command of the interactive session
+type replCommand struct {
+	name  string
+	args  string
+	short string
+	run   func(r *repl, args []string) error
+}
+
+var replCommands []replCommand
+
+func init() {
+	//assigned in init because the help command refers back to the command list
+	replCommands = []replCommand{
+		{"list", "", "Show the servers, IDs are the row numbers", (*repl).list},
+		{"search", "<name>", "List the servers whose name contains name", (*repl).search},
+		{"ping", "<id>", "Run a latency test", (*repl).ping},
+		{"test", "<id>", "Run the test phases, a bare ID does the same", (*repl).test},
+		{"down", "<id>", "Run a download test", (*repl).down},
+		{"up", "<id>", "Run an upload test", (*repl).up},
+		{"set", "[duration|phases|units] [value]", "Show or change a setting", (*repl).set},
+		{"history", "", "Show the tests of this session", (*repl).history},
+		{"compare", "", "Compare the servers tested in this session", (*repl).compare},
+		{"help", "", "Show the commands", (*repl).help},
+		{"quit", "", "Leave, \"exit\" and ctrl-d also work", nil},
+	}
+}
+
+// repl is an interactive session for exploring and testing servers
+type repl struct {
+	cfg     *stdn.Config
+	tp      stdn.TestPlan //plan run by test
+	servers []stdn.Testserver
+	runs    []run
+	pick    bool             //test ends the session, returning the server
+	chosen  *stdn.Testserver //the server picked by test
+	keys    *keyReader
+	lines   *bufio.Scanner //input when stdin is not a terminal
+	hist    []string
+}
+
+func newREPL(cfg *stdn.Config, servers []stdn.Testserver, tp stdn.TestPlan) *repl {
+	r := &repl{
+		cfg:     cfg,
+		tp:      tp,
+		servers: servers,
+	}
+	if _, _, err := prompt.TerminalSize(os.Stdin); err != nil {
+		r.lines = bufio.NewScanner(os.Stdin)
+	} else {
+		r.keys = newKeyReader(prompt.NewAnsiReader(os.Stdin))
+	}
+	return r
+}
+
+// runREPL runs an interactive session over the candidate servers until the user quits
+func runREPL(cfg *stdn.Config, servers []stdn.Testserver, tp stdn.TestPlan) {
+	r := newREPL(cfg, servers, tp)
+	fmt.Print(replIntro)
+	r.loop()
+	//a failed last test fails the session, so piping in an ID still reports the outcome
+	if n := len(r.runs); n > 0 && r.runs[n-1].err != nil && r.runs[n-1].err != stdn.ErrCanceled {
+		code, _ := testError(r.runs[n-1].err)
+		exit(code)
+	}
+}
+
+// pickServer runs an interactive session until the user picks a server to test
+func pickServer(cfg *stdn.Config, servers []stdn.Testserver, tp stdn.TestPlan) stdn.Testserver {
+	r := newREPL(cfg, servers, tp)
+	r.pick = true
+	fmt.Print(replPickIntro)
+	r.loop()
+	if r.chosen == nil {
+		os.Exit(exitOK)
+	}
+	return *r.chosen
+}
+
+func (r *repl) loop() {
+	for r.chosen == nil {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(errCodeInput, fmt.Errorf("input failure \"%v\"", err))
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		r.addHistory(line)
+		if !r.exec(line) {
+			return
+		}
+	}
+}
+
+// exec runs a command line, returning false when the user quits
+func (r *repl) exec(line string) bool {
+	args := strings.Fields(line)
+	name := strings.ToLower(args[0])
+	//be REALLY forgiving on exit logic
+	if strings.HasPrefix(name, "exit") || strings.HasPrefix(name, "quit") {
+		return false
+	}
+	//a bare ID tests that server, as the ID prompt always has
+	if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+		name, args = "test", append([]string{"test"}, args...)
+	}
+	for _, c := range replCommands {
+		if c.name == name && c.run != nil {
+			if err := c.run(r, args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			return true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q, type \"help\" for the commands\n", args[0])
+	return true
+}
+
+func (r *repl) help(args []string) error {
+	for _, c := range replCommands {
+		fmt.Printf("  %-36s %s\n", strings.TrimSpace(c.name+" "+c.args), c.short)
+	}
+	return nil
+}
+
+func (r *repl) list(args []string) error {
+	printServers(r.servers)
+	return nil
+}
+
+func (r *repl) search(args []string) error {
+	if len(args) == 0 {
+		return errors.New("search needs part of a server name")
+	}
+	servers, err := getSearchServers(r.cfg, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	r.servers = servers
+	printServers(r.servers)
+	return nil
+}
+
+func (r *repl) ping(args []string) error {
+	return r.run("ping", args, stdn.PhaseLatency)
+}
+
+func (r *repl) down(args []string) error {
+	return r.run("down", args, stdn.PhaseDownload)
+}
+
+func (r *repl) up(args []string) error {
+	return r.run("up", args, stdn.PhaseUpload)
+}
+
+func (r *repl) test(args []string) error {
+	if !r.pick {
+		return r.run("test", args, r.tp.Phases()...)
+	}
+	srv, err := r.server("test", args)
+	if err != nil {
+		return err
+	}
+	r.chosen = &srv
+	return nil
+}
+
+// server returns the server from the list named by the ID argument of a command
+func (r *repl) server(cmd string, args []string) (stdn.Testserver, error) {
+	if len(args) != 1 {
+		return stdn.Testserver{}, fmt.Errorf(replNeedsServer, cmd)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return stdn.Testserver{}, fmt.Errorf("\"%s\" is not a valid id", args[0])
+	}
+	if id >= uint64(len(r.servers)) {
+		return stdn.Testserver{}, fmt.Errorf("No server with ID \"%d\" available", id)
+	}
+	return r.servers[id], nil
+}
+
+// run tests a server from the list with the given phases, an interrupt cancels the test
+func (r *repl) run(cmd string, args []string, phases ...stdn.Phase) error {
+	srv, err := r.server(cmd, args)
+	if err != nil {
+		return err
+	}
+	tp := r.tp
+	tp.Latency, tp.Download, tp.Upload = false, false, false
+	for _, p := range phases {
+		switch p {
+		case stdn.PhaseLatency:
+			tp.Latency = true
+		case stdn.PhaseDownload:
+			tp.Download = true
+		case stdn.PhaseUpload:
+			tp.Upload = true
+		}
+	}
+	cancel := make(chan struct{})
+	tp.Cancel = cancel
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			close(cancel)
+		case <-done:
+		}
+	}()
+	fmt.Printf("Testing %s / %s\n", srv.Name, srv.Sponsor)
+	res, err := fullTest(r.cfg, srv, tp)
+	signal.Stop(sig)
+	close(done)
+	r.runs = append(r.runs, run{res, err})
+	if err == stdn.ErrCanceled {
+		return errors.New("Test canceled")
+	}
+	recordResult(r.cfg, res, err)
+	if err != nil {
+		_, msg := testError(err)
+		return msg
+	}
+	for _, m := range limits.check(res) {
+		fmt.Fprintf(os.Stderr, "%s\n", m)
+	}
+	return nil
+}
+
+func (r *repl) set(args []string) error {
+	if len(args) == 0 {
+		var ps []string
+		for _, p := range r.tp.Phases() {
+			ps = append(ps, string(p))
+		}
+		fmt.Printf("duration %d\nphases   %s\nunits    %s\n", r.tp.Duration, strings.Join(ps, ","), units.String())
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.New("set needs a setting and a value, e.g. \"set duration 10\"")
+	}
+	switch strings.ToLower(args[0]) {
+	case "duration":
+		d, err := strconv.Atoi(args[1])
+		if err != nil || d <= 0 {
+			return errors.New("Invalid test duration")
+		}
+		r.tp.Duration = d
+	case "phases":
+		tp := r.tp
+		if err := tp.ParsePhases(args[1]); err != nil {
+			return err
+		}
+		if len(tp.Phases()) == 0 {
+			return errors.New("No test phases selected")
+		}
+		r.tp = tp
+	case "units":
+		return units.Set(args[1])
+	default:
+		return fmt.Errorf("Unknown setting %q, settings are duration, phases and units", args[0])
+	}
+	return nil
+}
+
+func (r *repl) history(args []string) error {
+	if len(r.runs) == 0 {
+		fmt.Printf("No tests yet\n")
+		return nil
+	}
+	printRuns(r.runs)
+	return nil
+}
+
+// compare summarizes the tests of each server, best download first, marking the best of each measurement
+func (r *repl) compare(args []string) error {
+	byServer := make(map[uint][]run)
+	var ids []uint
+	for _, rn := range r.runs {
+		id := rn.res.Server.ID
+		if _, ok := byServer[id]; !ok {
+			ids = append(ids, id)
+		}
+		byServer[id] = append(byServer[id], rn)
+	}
+	if len(ids) < 2 {
+		return errors.New("Test at least two servers to compare them")
+	}
+	sums := make(map[uint]jsonSummary)
+	for _, id := range ids {
+		sums[id] = summarize(byServer[id])
+	}
+	median := func(st *stat) float64 {
+		if st == nil {
+			return 0
+		}
+		return st.Median
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return median(sums[ids[i]].Download) > median(sums[ids[j]].Download)
+	})
+	best := func(pick func(jsonSummary) *stat, lower bool) (bestID uint) {
+		var bv float64
+		for _, id := range ids {
+			st := pick(sums[id])
+			if st == nil {
+				continue
+			}
+			if bestID == 0 || (lower && st.Median < bv) || (!lower && st.Median > bv) {
+				bestID, bv = id, st.Median
+			}
+		}
+		return
+	}
+	bestLat := best(func(s jsonSummary) *stat { return s.Latency }, true)
+	bestDl := best(func(s jsonSummary) *stat { return s.Download }, false)
+	bestUl := best(func(s jsonSummary) *stat { return s.Upload }, false)
+	cell := func(st *stat, isBest bool, f func(float64) string) string {
+		if st == nil {
+			return "-"
+		}
+		return markBest(f(st.Median), isBest)
+	}
+	msCell := func(v float64) string { return fmt.Sprintf("%.02fms", v) }
+	bpsCell := func(v float64) string { return humanSpeed(uint64(v)) }
+	var data [][]string
+	for _, id := range ids {
+		sum := sums[id]
+		srv := byServer[id][0].res.Server
+		data = append(data, []string{fmt.Sprintf("%d", id), srv.Sponsor, srv.Name,
+			fmt.Sprintf("%d", sum.Runs), fmt.Sprintf("%d", sum.Failures),
+			cell(sum.Latency, id == bestLat, msCell), cell(sum.Jitter, false, msCell),
+			cell(sum.Download, id == bestDl, bpsCell), cell(sum.Upload, id == bestUl, bpsCell)})
+	}
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"Server", "Sponsor", "Name", "Tests", "Failed", "Latency", "Jitter", "Download", "Upload"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+	fmt.Printf("Medians of each server's tests, * marks the best\n")
+	return nil
+}
+
+// printServers shows the servers with their row numbers as IDs
+func printServers(servers []stdn.Testserver) {
+	var data [][]string
+	for i, srv := range servers {
+		lat := "-"
+		if srv.Latency > 0 {
+			lat = srv.Latency.String()
+		}
+		data = append(data, []string{fmt.Sprintf("%d", i), srv.Name, srv.Sponsor,
+			fmt.Sprintf("%.02f", srv.Distance), lat})
+	}
+	t := gotabulate.Create(data)
+	t.SetHeaders([]string{"ID", "Name", "Sponsor", "Distance (km)", "Latency"})
+	t.SetWrapStrings(false)
+	fmt.Printf("%s", t.Render(tableFormat))
+}
+
+func (r *repl) addHistory(line string) {
+	if n := len(r.hist); n > 0 && r.hist[n-1] == line {
+		return
+	}
+	r.hist = append(r.hist, line)
+	if len(r.hist) > maxReplHistory {
+		r.hist = r.hist[1:]
+	}
+}
+
+// readLine reads a command line, with editing, history and tab completion on a terminal
+func (r *repl) readLine() (string, error) {
+	if r.lines != nil {
+		fmt.Print(replPrompt)
+		if !r.lines.Scan() {
+			if err := r.lines.Err(); err != nil {
+				return "", err
+			}
+			fmt.Println()
+			return "", io.EOF
+		}
+		return r.lines.Text(), nil
+	}
+	//raw mode only while editing so command output is printed normally
+	term, err := prompt.NewTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer term.Close()
+	buf := prompt.NewBuffer(replPrompt, term.Out, true)
+	if buf.Cols, _, err = prompt.TerminalSize(term.Out); err != nil {
+		return "", err
+	}
+	if err = buf.Refresh(); err != nil {
+		return "", err
+	}
+	//the line being edited is kept while browsing the history
+	hidx, draft := len(r.hist), ""
+	for {
+		k, err := r.keys.next()
+		if err != nil {
+			return "", err
+		}
+		switch k {
+		case keyEnter:
+			return buf.String(), buf.EndLine()
+		case keyCtrlC:
+			//abandon the line, as shells do
+			fmt.Fprint(term.Out, "^C")
+			return "", buf.EndLine()
+		case keyCtrlD:
+			if buf.String() == "" {
+				buf.EndLine()
+				return "", io.EOF
+			}
+			err = buf.Del()
+		case keyBackspace:
+			err = buf.DelLeft()
+		case keyDel:
+			err = buf.Del()
+		case keyLeft:
+			err = buf.Left()
+		case keyRight:
+			err = buf.Right()
+		case keyHome, "\x01":
+			err = buf.Start()
+		case keyEnd, "\x05":
+			err = buf.End()
+		case "\x15":
+			err = buf.Set()
+		case "\x0c":
+			err = buf.ClsScreen()
+		case keyUp, keyDown:
+			if hidx == len(r.hist) {
+				draft = buf.String()
+			}
+			if k == keyUp && hidx > 0 {
+				hidx--
+			} else if k == keyDown && hidx < len(r.hist) {
+				hidx++
+			}
+			line := draft
+			if hidx < len(r.hist) {
+				line = r.hist[hidx]
+			}
+			err = buf.Set([]rune(line)...)
+		case keyTab:
+			err = r.complete(buf)
+		default:
+			if rs := []rune(string(k)); len(rs) == 1 && unicode.IsPrint(rs[0]) {
+				err = buf.Insert(rs[0])
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// complete extends the word before the cursor, which must be at the end of the line,
+// listing the candidates when there is more than one
+func (r *repl) complete(buf *prompt.Buffer) error {
+	line := buf.String()
+	var prefix string
+	var cands []string
+	if i := strings.IndexByte(line, ' '); i < 0 {
+		prefix = line
+		for _, c := range replCommands {
+			cands = append(cands, c.name)
+		}
+	} else {
+		prefix = strings.TrimLeft(line[i+1:], " ")
+		cands = r.argCandidates(strings.ToLower(line[:i]), prefix)
+	}
+	var matches []string
+	for _, c := range cands {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(prefix)) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	ext := commonPrefix(matches)
+	if len(matches) == 1 {
+		ext += " "
+	}
+	if len(ext) > len(prefix) {
+		//replace the typed prefix so the case of the candidate wins
+		return buf.Set([]rune(line[:len(line)-len(prefix)] + ext)...)
+	}
+	if len(matches) > maxCompletions {
+		matches = append(matches[:maxCompletions], fmt.Sprintf("(%d more)", len(matches)-maxCompletions))
+	}
+	fmt.Fprintf(buf.Out, "\r\n%s\r\n", strings.Join(matches, "  "))
+	return buf.Refresh()
+}
+
+// argCandidates lists the completions of the argument of a command
+func (r *repl) argCandidates(cmd, prefix string) []string {
+	var cands []string
+	switch cmd {
+	case "set":
+		cands = []string{"duration", "phases", "units"}
+	case "search":
+		seen := make(map[string]bool)
+		for _, srv := range r.cfg.Servers {
+			if !seen[srv.Name] {
+				seen[srv.Name] = true
+				cands = append(cands, srv.Name)
+			}
+		}
+	case "ping", "test", "down", "up":
+		for i := range r.servers {
+			cands = append(cands, strconv.Itoa(i))
+		}
+	}
+	return cands
+}
+
+// commonPrefix returns the longest case insensitive prefix shared by every string,
+// taken from the first string
+func commonPrefix(ss []string) string {
+	p := []rune(ss[0])
+	for _, s := range ss[1:] {
+		rs := []rune(s)
+		n := 0
+		for n < len(p) && n < len(rs) && unicode.ToLower(p[n]) == unicode.ToLower(rs[n]) {
+			n++
+		}
+		p = p[:n]
+	}
+	return string(p)
+}
@@ -51,7 +51,8 @@ var (
 	startBlockSize           = uint64(4096) //4KB
 	dataBlock                []byte
 
-	ErrTimeout = errors.New("Timeout")
+	ErrTimeout  = errors.New("Timeout")
+	ErrCanceled = errors.New("Test canceled")
 )
 
 func init() {
@@ -64,7 +65,15 @@ func init() {
 
 type durations []time.Duration
 
-func (ts *Testserver) ping(count int) ([]time.Duration, error) {
+// Transfer describes a completed bandwidth test
+type Transfer struct {
+	Bps      uint64        //speed of the final, correctly sized, transfer
+	Bytes    uint64        //total bytes moved across all transfers
+	Duration time.Duration //total time spent moving data
+	Loaded   *LatencyStats //latency measured while the transfer ran, when requested
+}
+
+func (ts *Testserver) ping(count int, cancel <-chan struct{}) ([]time.Duration, error) {
 	var errRet []time.Duration
 	if count > latencyMaxTestCount {
 		return errRet, errDontBeADick
@@ -75,29 +84,18 @@ func (ts *Testserver) ping(count int) ([]time.Duration, error) {
 		return errRet, ErrTimeout
 	}
 	defer conn.Close()
+	defer closeOnCancel(conn, cancel)()
 
 	durs := []time.Duration{}
 	buff := make([]byte, 256)
 	for i := 0; i < count; i++ {
-		t := time.Now()
-		fmt.Fprintf(conn, "PING %d\n", uint(t.UnixNano()/1000000))
-		conn.SetReadDeadline(time.Now().Add(pingTimeout))
-		n, err := conn.Read(buff)
+		d, err := pingOnce(conn, buff, time.Now().Add(pingTimeout))
 		if err != nil {
+			if canceled(cancel) {
+				err = ErrCanceled
+			}
 			return errRet, err
 		}
-		conn.SetReadDeadline(time.Time{})
-		d := time.Since(t)
-		flds := strings.Fields(strings.TrimRight(string(buff[0:n]), "\n"))
-		if len(flds) != 2 {
-			return errRet, errInvalidServerResponse
-		}
-		if flds[0] != "PONG" {
-			return errRet, errInvalidServerResponse
-		}
-		if _, err = strconv.ParseInt(flds[1], 10, 64); err != nil {
-			return errRet, errInvalidServerResponse
-		}
 		durs = append(durs, d)
 	}
 	if len(durs) != count {
@@ -106,10 +104,34 @@ func (ts *Testserver) ping(count int) ([]time.Duration, error) {
 	return durs, nil
 }
 
+// pingOnce sends a single PING on conn and waits until deadline for the PONG
+func pingOnce(conn net.Conn, buff []byte, deadline time.Time) (time.Duration, error) {
+	t := time.Now()
+	fmt.Fprintf(conn, "PING %d\n", uint(t.UnixNano()/1000000))
+	conn.SetReadDeadline(deadline)
+	n, err := conn.Read(buff)
+	if err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	d := time.Since(t)
+	flds := strings.Fields(strings.TrimRight(string(buff[0:n]), "\n"))
+	if len(flds) != 2 {
+		return 0, errInvalidServerResponse
+	}
+	if flds[0] != "PONG" {
+		return 0, errInvalidServerResponse
+	}
+	if _, err = strconv.ParseInt(flds[1], 10, 64); err != nil {
+		return 0, errInvalidServerResponse
+	}
+	return d, nil
+}
+
 // MedianPing runs a latency test against the server and stores the median latency
 func (ts *Testserver) MedianPing(count int) (time.Duration, error) {
 	var errRet time.Duration
-	durs, err := ts.ping(count)
+	durs, err := ts.ping(count, nil)
 	if err != nil {
 		return errRet, err
 	}
@@ -120,7 +142,7 @@ func (ts *Testserver) MedianPing(count int) (time.Duration, error) {
 
 // Ping will run count number of latency tests and return the results of each
 func (ts *Testserver) Ping(count int) ([]time.Duration, error) {
-	return ts.ping(count)
+	return ts.ping(count, nil)
 }
 
 // throwBytes chucks bytes at the remote server then listens for a response
@@ -179,19 +201,36 @@ func readBytes(rdr io.Reader, count uint64) error {
 
 // Upstream measures upstream bandwidth in bps
 func (ts *Testserver) Upstream(duration int, interface_id string) (uint64, error) {
-	var currBps uint64
+	xfer, err := ts.UpstreamTransfer(duration, interface_id)
+	if err != nil {
+		return 0, err
+	}
+	return xfer.Bps, nil
+}
+
+// UpstreamTransfer measures upstream bandwidth, also reporting how much data was sent
+func (ts *Testserver) UpstreamTransfer(duration int, interface_id string) (Transfer, error) {
+	return ts.UpstreamProgress(duration, interface_id, nil)
+}
+
+// UpstreamProgress measures upstream bandwidth, calling fn with the progress as data is sent
+func (ts *Testserver) UpstreamProgress(duration int, interface_id string, fn ProgressFunc) (Transfer, error) {
+	return ts.upstream(duration, interface_id, transferOptions{progress: fn})
+}
+
+func (ts *Testserver) upstream(duration int, interface_id string, xo transferOptions) (xfer Transfer, err error) {
 	sz := startBlockSize
 	var localAddr *net.TCPAddr
 	if interface_id != `` {
 		// if a source interface is specified, resolve it and set the localAddr for the dialer
 		intf, err := net.InterfaceByName(interface_id)
 		if err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		addrs, err := intf.Addrs()
 		if err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		// Create a TCP address using the IP address of the interface
@@ -209,41 +248,46 @@ func (ts *Testserver) Upstream(duration int, interface_id string) (uint64, error
 	// Establish a connection to the speed test server
 	conn, err := dialer.Dial("tcp", ts.Host)
 	if err != nil {
-		return 0, err
+		return xfer, err
 	}
 	targetTestDuration := time.Second * time.Duration(duration)
 	defer conn.Close()
+	tr := xo.start(conn, ts.Host)
+	defer tr.finish(&xfer, &err)
+	mtr := newMeter(conn, PhaseUpload, tr)
 
 	//we repeat the tests until we have a test that lasts at least N seconds
 	for i := 0; i < maxDownstreamTestCount; i++ {
 		//request a download of size sz and set a deadline
 		if err = conn.SetWriteDeadline(time.Now().Add(cmdTimeout)); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		cmdStr := fmt.Sprintf("UPLOAD %d 0\n", sz)
 		if _, err := conn.Write([]byte(cmdStr)); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		if err = conn.SetWriteDeadline(time.Time{}); err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		ts := time.Now() //set start time mark
 		if err = conn.SetWriteDeadline(time.Now().Add(speedTestTimeout)); err != nil {
-			return 0, err
+			return xfer, err
 		}
-		if err := throwBytes(conn, sz-uint64(len(cmdStr))); err != nil {
-			return 0, err
+		if err := throwBytes(mtr, sz-uint64(len(cmdStr))); err != nil {
+			return xfer, err
 		}
 		if err = conn.SetReadDeadline(time.Time{}); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		//check if our test was a reasonable timespan
 		dur := time.Since(ts)
-		currBps = bps(sz, dur)
+		xfer.Bytes += sz
+		xfer.Duration += dur
+		xfer.Bps = bps(sz, dur)
 		if dur.Nanoseconds() > targetTestDuration.Nanoseconds() || sz >= maxTransferSize {
 			_, err = fmt.Fprintf(conn, "QUIT\n")
-			return bps(sz, dur), err
+			return xfer, err
 		}
 		//test was too short, try again
 		sz = calcNextSize(sz, dur)
@@ -253,24 +297,41 @@ func (ts *Testserver) Upstream(duration int, interface_id string) (uint64, error
 	}
 
 	_, err = fmt.Fprintf(conn, "QUIT\n")
-	return currBps, err
+	return xfer, err
 }
 
-// Downstream measures upstream bandwidth in bps
+// Downstream measures downstream bandwidth in bps
 func (ts *Testserver) Downstream(duration int, interface_id string) (uint64, error) {
-	var currBps uint64
+	xfer, err := ts.DownstreamTransfer(duration, interface_id)
+	if err != nil {
+		return 0, err
+	}
+	return xfer.Bps, nil
+}
+
+// DownstreamTransfer measures downstream bandwidth, also reporting how much data was received
+func (ts *Testserver) DownstreamTransfer(duration int, interface_id string) (Transfer, error) {
+	return ts.DownstreamProgress(duration, interface_id, nil)
+}
+
+// DownstreamProgress measures downstream bandwidth, calling fn with the progress as data is received
+func (ts *Testserver) DownstreamProgress(duration int, interface_id string, fn ProgressFunc) (Transfer, error) {
+	return ts.downstream(duration, interface_id, transferOptions{progress: fn})
+}
+
+func (ts *Testserver) downstream(duration int, interface_id string, xo transferOptions) (xfer Transfer, err error) {
 	sz := startBlockSize
 	var localAddr *net.TCPAddr
 	if interface_id != `` {
 		// if a source interface is specified, resolve it and set the localAddr for the dialer
 		intf, err := net.InterfaceByName(interface_id)
 		if err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		addrs, err := intf.Addrs()
 		if err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		// Create a TCP address using the IP address of the interface
@@ -288,39 +349,44 @@ func (ts *Testserver) Downstream(duration int, interface_id string) (uint64, err
 	// Establish a connection to the speed test server
 	conn, err := dialer.Dial("tcp", ts.Host)
 	if err != nil {
-		return 0, err
+		return xfer, err
 	}
 	defer conn.Close()
+	tr := xo.start(conn, ts.Host)
+	defer tr.finish(&xfer, &err)
+	mtr := newMeter(conn, PhaseDownload, tr)
 
 	targetTestDuration := time.Second * time.Duration(duration)
 	//we repeat the tests until we have a test that lasts at least N seconds
 	for i := 0; i < maxDownstreamTestCount; i++ {
 		//request a download of size sz and set a deadline
 		if err = conn.SetWriteDeadline(time.Now().Add(cmdTimeout)); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		fmt.Fprintf(conn, "DOWNLOAD %d\n", sz)
 		if err = conn.SetWriteDeadline(time.Time{}); err != nil {
-			return 0, err
+			return xfer, err
 		}
 
 		ts := time.Now() //set start time mark
 		if err = conn.SetReadDeadline(time.Now().Add(speedTestTimeout)); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		//read until we get a newline
-		if err = readBytes(conn, sz); err != nil {
-			return 0, err
+		if err = readBytes(mtr, sz); err != nil {
+			return xfer, err
 		}
 		if err = conn.SetReadDeadline(time.Time{}); err != nil {
-			return 0, err
+			return xfer, err
 		}
 		//check if our test was a reasonable timespan
 		dur := time.Since(ts)
-		currBps = bps(sz, dur)
+		xfer.Bytes += sz
+		xfer.Duration += dur
+		xfer.Bps = bps(sz, dur)
 		if dur.Nanoseconds() > targetTestDuration.Nanoseconds() || sz >= maxTransferSize {
 			_, err = fmt.Fprintf(conn, "QUIT\n")
-			return bps(sz, dur), err
+			return xfer, err
 		}
 		//test was too short, try again
 		sz = calcNextSize(sz, dur)
@@ -330,7 +396,7 @@ func (ts *Testserver) Downstream(duration int, interface_id string) (uint64, err
 	}
 
 	_, err = fmt.Fprintf(conn, "QUIT\n")
-	return currBps, err
+	return xfer, err
 }
 
 // calcNextSize takes the current preformance metrics and
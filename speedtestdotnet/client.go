@@ -0,0 +1,192 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/traetox/speedtest/version"
+)
+
+var (
+	// DefaultUserAgent identifies this library to the configuration endpoints
+	DefaultUserAgent = "Mozilla/5.0 (compatible; speedtest/" + version.Version + "; +https://github.com/traetox/speedtest)"
+	// DefaultConfigURLs are the client configuration endpoints, tried in order
+	DefaultConfigURLs = []string{clientConfigUrl}
+	// DefaultServerURLs are the server list endpoints, tried in order
+	DefaultServerURLs = []string{serversJSONUrl, serversConfigUrl}
+
+	errNoURLs = errors.New("No endpoint URLs configured")
+)
+
+const (
+	defaultRetries = 2
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	maxErrorBody   = 512 //bytes of the response body kept in an HTTPError
+)
+
+// HTTPError is returned when an endpoint responds with a status other than 200 OK
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string //leading portion of the response body
+	Header     http.Header
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("Invalid status %d from %s", e.StatusCode, e.URL)
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// RetryAfter returns the delay the server asked for in the Retry-After header
+func (e *HTTPError) RetryAfter() (time.Duration, bool) {
+	v := e.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// Client fetches the client configuration and server lists.
+// Multiple URLs are treated as mirrors and tried in order until one succeeds.
+type Client struct {
+	ConfigURLs   []string
+	ServerURLs   []string
+	UserAgent    string
+	Timeout      time.Duration //timeout for each individual request
+	HTTPFallback bool          //retry https URLs over plain http if the https connection fails
+	Retries      int           //retries of each URL after a 429 or 5xx response
+	Backoff      time.Duration //delay before the first retry, doubled on each retry
+}
+
+// NewClient returns a client using the default speedtest.net endpoints over HTTPS
+func NewClient() *Client {
+	return &Client{
+		ConfigURLs:   DefaultConfigURLs,
+		ServerURLs:   DefaultServerURLs,
+		UserAgent:    DefaultUserAgent,
+		Timeout:      getTimeout,
+		HTTPFallback: true,
+		Retries:      defaultRetries,
+		Backoff:      defaultBackoff,
+	}
+}
+
+// getFirst requests each URL in order, stopping at the first that is fetched and decoded
+func (c *Client) getFirst(urls []string, dec func(string, io.Reader) error) error {
+	err := errNoURLs
+	for _, u := range urls {
+		if err = c.get(u, dec); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// get requests a single URL, downgrading to plain HTTP when the HTTPS connection fails.
+// A server which answered with an error status is not retried over plain HTTP.
+func (c *Client) get(url string, dec func(string, io.Reader) error) error {
+	err := c.getRetry(url, dec)
+	if err == nil || !c.HTTPFallback || !strings.HasPrefix(url, "https://") {
+		return err
+	}
+	if _, ok := err.(*HTTPError); ok {
+		return err
+	}
+	if c.getRetry("http://"+strings.TrimPrefix(url, "https://"), dec) == nil {
+		return nil
+	}
+	return err
+}
+
+// getRetry requests a URL, backing off and retrying on temporary HTTP errors
+func (c *Client) getRetry(url string, dec func(string, io.Reader) error) error {
+	backoff := c.Backoff
+	for i := 0; ; i++ {
+		err := c.getOnce(url, dec)
+		herr, ok := err.(*HTTPError)
+		if !ok || !herr.Temporary() || i >= c.Retries {
+			return err
+		}
+		wait := backoff
+		if ra, ok := herr.RetryAfter(); ok && ra > wait {
+			wait = ra
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (c *Client) getOnce(url string, dec func(string, io.Reader) error) error {
+	clnt := http.Client{
+		Timeout: c.Timeout,
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	resp, err := clnt.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		x, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &HTTPError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       string(x),
+			Header:     resp.Header,
+		}
+	}
+	return dec(resp.Header.Get("Content-Type"), resp.Body)
+}
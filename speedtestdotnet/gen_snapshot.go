@@ -0,0 +1,67 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build ignore
+
+// gen_snapshot fetches the live server list and writes it out as the embedded snapshot
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+var (
+	out = flag.String("o", "snapshot.xml", "Output file")
+	url = flag.String("url", "", "Server list URL (default is the library server list endpoints)")
+)
+
+func main() {
+	flag.Parse()
+	clnt := stdn.NewClient()
+	if *url != "" {
+		clnt.ServerURLs = []string{*url}
+	}
+	srvs, err := clnt.GetServerList()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get server list: %v\n", err)
+		os.Exit(-1)
+	}
+	fout, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *out, err)
+		os.Exit(-1)
+	}
+	if err := stdn.WriteSnapshot(fout, srvs); err != nil {
+		fout.Close()
+		fmt.Fprintf(os.Stderr, "Failed to write snapshot: %v\n", err)
+		os.Exit(-1)
+	}
+	if err := fout.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write snapshot: %v\n", err)
+		os.Exit(-1)
+	}
+	fmt.Printf("Wrote %d servers to %s\n", len(srvs), *out)
+}
@@ -0,0 +1,268 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cacheDir        = "speedtest"
+	healthStoreFile = "health.json"
+	throughputAlpha = 0.3 //weight of the newest sample in the smoothed throughput
+	unknownFactor   = 0.5 //neutral score factor for servers we know nothing about
+)
+
+// ScoreWeights controls how much each factor contributes to a server score
+type ScoreWeights struct {
+	Latency    float64
+	Distance   float64
+	Throughput float64
+	Failure    float64
+}
+
+// DefaultScoreWeights favors current latency, then past reliability and throughput
+var DefaultScoreWeights = ScoreWeights{
+	Latency:    0.4,
+	Distance:   0.1,
+	Throughput: 0.2,
+	Failure:    0.3,
+}
+
+// ServerHealth is the test history of a single server
+type ServerHealth struct {
+	Tests               int       `json:"tests"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Downstream          uint64    `json:"downstream_bps"` //smoothed download speed
+	Upstream            uint64    `json:"upstream_bps"`   //smoothed upload speed
+	LastTest            time.Time `json:"last_test"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// HealthStore is a persistent record of server health keyed by server ID
+type HealthStore struct {
+	mtx     sync.Mutex
+	path    string
+	servers map[uint]*ServerHealth
+}
+
+// DefaultHealthStorePath returns the health store location in the user cache directory
+func DefaultHealthStorePath() (string, error) {
+	return cachePath(healthStoreFile)
+}
+
+// cachePath returns the location of a file in our user cache directory
+func cachePath(name string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, cacheDir, name), nil
+}
+
+// OpenHealthStore loads the health store at path, a missing file is an empty store
+func OpenHealthStore(path string) (*HealthStore, error) {
+	hs := &HealthStore{
+		path:    path,
+		servers: make(map[uint]*ServerHealth),
+	}
+	fin, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hs, nil
+		}
+		return nil, err
+	}
+	defer fin.Close()
+	if err := json.NewDecoder(fin).Decode(&hs.servers); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// Save writes the health store back to disk
+func (hs *HealthStore) Save() error {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	return saveJSON(hs.path, hs.servers)
+}
+
+// saveJSON encodes v to path, writing to a temporary file and renaming so
+// a crash never leaves a truncated file behind
+func saveJSON(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	fout, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fout).Encode(v); err != nil {
+		fout.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get returns the health record for a server
+func (hs *HealthStore) Get(id uint) (ServerHealth, bool) {
+	if hs == nil {
+		return ServerHealth{}, false
+	}
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	sh, ok := hs.servers[id]
+	if !ok {
+		return ServerHealth{}, false
+	}
+	return *sh, true
+}
+
+// RecordSuccess records a completed test, a zero speed means that direction was not tested
+func (hs *HealthStore) RecordSuccess(id uint, downstream, upstream uint64) {
+	if hs == nil {
+		return
+	}
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	sh := hs.get(id)
+	sh.Tests++
+	sh.ConsecutiveFailures = 0
+	sh.LastTest = time.Now()
+	sh.LastError = ""
+	sh.Downstream = smooth(sh.Downstream, downstream)
+	sh.Upstream = smooth(sh.Upstream, upstream)
+}
+
+// RecordFailure records a failed test.  Only failures which point at the server,
+// such as timeouts or the server hanging up on us, count against it.
+func (hs *HealthStore) RecordFailure(id uint, err error) {
+	if hs == nil || !isServerFault(err) {
+		return
+	}
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	sh := hs.get(id)
+	sh.Tests++
+	sh.Failures++
+	sh.ConsecutiveFailures++
+	sh.LastTest = time.Now()
+	sh.LastError = err.Error()
+}
+
+func (hs *HealthStore) get(id uint) *ServerHealth {
+	sh, ok := hs.servers[id]
+	if !ok {
+		sh = &ServerHealth{}
+		hs.servers[id] = sh
+	}
+	return sh
+}
+
+// RankServers scores the responding probe results using the current latency, distance,
+// and the history in hs (which may be nil) and returns them best first.  Each factor is
+// normalized against the worst candidate so the weights are comparable.
+func RankServers(probes []ProbeResult, hs *HealthStore, w ScoreWeights) []ProbeResult {
+	var ranked []ProbeResult
+	var maxLat time.Duration
+	var maxDist float64
+	var maxTput uint64
+	for i := range probes {
+		if probes[i].Err != nil {
+			continue
+		}
+		ranked = append(ranked, probes[i])
+		if probes[i].Latency > maxLat {
+			maxLat = probes[i].Latency
+		}
+		if probes[i].Server.Distance > maxDist {
+			maxDist = probes[i].Server.Distance
+		}
+		if sh, ok := hs.Get(probes[i].Server.ID); ok && sh.Downstream > maxTput {
+			maxTput = sh.Downstream
+		}
+	}
+	for i := range ranked {
+		sh, ok := hs.Get(ranked[i].Server.ID)
+		lat := ratio(float64(ranked[i].Latency), float64(maxLat))
+		//lost pings are as bad as the worst latency
+		lat += ranked[i].Loss
+		dist := ratio(ranked[i].Server.Distance, maxDist)
+		tput := unknownFactor
+		if ok && sh.Downstream > 0 && maxTput > 0 {
+			tput = 1 - ratio(float64(sh.Downstream), float64(maxTput))
+		}
+		fail := unknownFactor
+		if ok && sh.Tests > 0 {
+			fail = float64(sh.Failures) / float64(sh.Tests)
+			//repeat offenders get pushed down hard
+			fail += float64(sh.ConsecutiveFailures)
+		}
+		ranked[i].Score = w.Latency*lat + w.Distance*dist + w.Throughput*tput + w.Failure*fail
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score < ranked[j].Score
+	})
+	return ranked
+}
+
+func isServerFault(err error) bool {
+	if err == ErrTimeout || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+func smooth(old, sample uint64) uint64 {
+	if sample == 0 {
+		return old
+	}
+	if old == 0 {
+		return sample
+	}
+	return uint64(throughputAlpha*float64(sample) + (1-throughputAlpha)*float64(old))
+}
+
+func ratio(v, max float64) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return v / max
+}
@@ -0,0 +1,257 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/traetox/speedtest/version"
+)
+
+const (
+	historyFile    = "history.jsonl"
+	pushBufferFile = "push-buffer.lp"
+	maxHistoryLine = 1024 * 1024
+)
+
+// HistoryEntry is the recorded outcome of a single test
+type HistoryEntry struct {
+	Time      time.Time        `json:"time"`
+	Duration  float64          `json:"duration_seconds"`
+	Version   string           `json:"version"`
+	ClientIP  string           `json:"client_ip,omitempty"`
+	ISP       string           `json:"isp,omitempty"`
+	Interface string           `json:"interface,omitempty"`
+	Server    HistoryServer    `json:"server"`
+	Phases    []Phase          `json:"phases"`
+	Latency   *HistoryLatency  `json:"latency,omitempty"`
+	Download  *HistoryTransfer `json:"download,omitempty"`
+	Upload    *HistoryTransfer `json:"upload,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// HistoryServer identifies the server a test ran against
+type HistoryServer struct {
+	ID       uint    `json:"id"`
+	Name     string  `json:"name"`
+	Sponsor  string  `json:"sponsor"`
+	Host     string  `json:"host"`
+	Distance float64 `json:"distance_km"`
+}
+
+// HistoryLatency is the summary of a latency phase in milliseconds
+type HistoryLatency struct {
+	Min    float64 `json:"min_ms"`
+	Avg    float64 `json:"avg_ms"`
+	Median float64 `json:"median_ms"`
+	Max    float64 `json:"max_ms"`
+	Jitter float64 `json:"jitter_ms"`
+}
+
+// HistoryTransfer is the outcome of a bandwidth phase
+type HistoryTransfer struct {
+	Bps      uint64  `json:"bps"`
+	Bytes    uint64  `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// HistoryFilter selects history entries, zero values match everything
+type HistoryFilter struct {
+	Since     time.Time
+	Until     time.Time
+	ServerID  uint
+	Interface string
+}
+
+// History is an append-only log of test outcomes stored as one JSON document per line
+type History struct {
+	mtx  sync.Mutex
+	path string
+}
+
+// DefaultHistoryPath returns the history location in the user data directory
+func DefaultHistoryPath() (string, error) {
+	return dataPath(historyFile)
+}
+
+// DefaultPushBufferPath returns the location results are buffered in while a push endpoint is down
+func DefaultPushBufferPath() (string, error) {
+	return cachePath(pushBufferFile)
+}
+
+// dataPath returns the location of a file in our user data directory, which
+// follows the XDG base directory spec on unix systems
+func dataPath(name string) (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		var err error
+		switch runtime.GOOS {
+		case "windows", "darwin", "ios", "plan9":
+			dir, err = os.UserConfigDir()
+		default:
+			dir, err = os.UserHomeDir()
+			dir = filepath.Join(dir, ".local", "share")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, cacheDir, name), nil
+}
+
+// NewHistory returns the history stored at path, the file is created on the first append
+func NewHistory(path string) *History {
+	return &History{path: path}
+}
+
+// NewHistoryEntry builds a history entry from a test result and the error which ended it, if any
+func NewHistoryEntry(cfg *Config, res *Result, err error) HistoryEntry {
+	he := HistoryEntry{
+		Time:      res.Start.UTC(),
+		Duration:  res.End.Sub(res.Start).Seconds(),
+		Version:   version.Version,
+		Interface: res.Interface,
+		Server: HistoryServer{
+			ID:       res.Server.ID,
+			Name:     res.Server.Name,
+			Sponsor:  res.Server.Sponsor,
+			Host:     res.Server.Host,
+			Distance: res.Server.Distance,
+		},
+		Phases:   res.Phases(),
+		Download: newHistoryTransfer(res.Download),
+		Upload:   newHistoryTransfer(res.Upload),
+	}
+	if cfg != nil {
+		he.ISP = cfg.ISP
+		if cfg.IP != nil {
+			he.ClientIP = cfg.IP.String()
+		}
+	}
+	if ls := res.Latency; ls != nil {
+		he.Latency = &HistoryLatency{
+			Min:    msec(ls.Min),
+			Avg:    msec(ls.Avg),
+			Median: msec(ls.Median),
+			Max:    msec(ls.Max),
+			Jitter: msec(ls.Jitter),
+		}
+	}
+	if err != nil {
+		he.Error = err.Error()
+	}
+	return he
+}
+
+func newHistoryTransfer(xfer *Transfer) *HistoryTransfer {
+	if xfer == nil {
+		return nil
+	}
+	return &HistoryTransfer{
+		Bps:      xfer.Bps,
+		Bytes:    xfer.Bytes,
+		Duration: xfer.Duration.Seconds(),
+	}
+}
+
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Append adds an entry to the end of the history
+func (h *History) Append(he HistoryEntry) error {
+	if h == nil {
+		return nil
+	}
+	buff, err := json.Marshal(he)
+	if err != nil {
+		return err
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+	fout, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	//a single write keeps concurrent appends from interleaving
+	if _, err = fout.Write(append(buff, '\n')); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// Query returns the entries matching the filter, oldest first.
+// Lines which cannot be decoded, such as one truncated by a crash, are skipped.
+func (h *History) Query(f HistoryFilter) ([]HistoryEntry, error) {
+	if h == nil {
+		return nil, nil
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fin, err := os.Open(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fin.Close()
+	var hes []HistoryEntry
+	scn := bufio.NewScanner(fin)
+	scn.Buffer(make([]byte, 4096), maxHistoryLine)
+	for scn.Scan() {
+		var he HistoryEntry
+		if err := json.Unmarshal(scn.Bytes(), &he); err != nil {
+			continue
+		}
+		if f.Match(he) {
+			hes = append(hes, he)
+		}
+	}
+	return hes, scn.Err()
+}
+
+// Match reports whether an entry passes the filter
+func (f HistoryFilter) Match(he HistoryEntry) bool {
+	switch {
+	case !f.Since.IsZero() && he.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !he.Time.Before(f.Until):
+		return false
+	case f.ServerID != 0 && he.Server.ID != f.ServerID:
+		return false
+	case f.Interface != "" && he.Interface != f.Interface:
+		return false
+	}
+	return true
+}
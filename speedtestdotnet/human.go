@@ -23,35 +23,230 @@
 package speedtestdotnet
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 )
 
+// Binary multiples of a byte expressed in bits, kept for compatibility
 const (
-	bits        = 8
-	kb          = 1024
-	mb          = 1024 * kb
-	gb          = 1024 * mb
-	tb          = 1024 * gb
-	pb          = 1024 * tb
-	KB          = 1024 * bits
-	MB          = 1024 * KB
-	GB          = 1024 * MB
-	TB          = 1024 * GB
-	PB          = 1024 * TB
-	tooDamnFast = "Too fast to test"
+	bits = 8
+	KB   = 1024 * bits
+	MB   = 1024 * KB
+	GB   = 1024 * MB
+	TB   = 1024 * GB
+	PB   = 1024 * TB
 )
 
+// UnitSystem selects decimal or binary unit prefixes
+type UnitSystem int
+
+const (
+	SI  UnitSystem = iota //powers of 1000: kbit/s, Mbit/s, as advertised by ISPs
+	IEC                   //powers of 1024: Kibit/s, Mibit/s
+)
+
+// SpeedFormat controls how speeds are formatted
+type SpeedFormat struct {
+	System    UnitSystem
+	Bytes     bool   //bytes per second rather than bits
+	Precision int    //digits after the decimal point
+	Prefix    string //fixed prefix such as "M" or "Mi", empty scales to the largest prefix
+}
+
+// DefaultSpeedFormat formats auto scaled SI bits per second with two decimal places
+var DefaultSpeedFormat = SpeedFormat{System: SI, Precision: 2}
+
+var (
+	siPrefixes  = []string{"", "k", "M", "G", "T", "P", "E"}
+	iecPrefixes = []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+
+	errInvalidSpeed = errors.New("invalid speed")
+)
+
+// HumanSpeed formats a speed in bits per second with the default format
 func HumanSpeed(bps uint64) string {
-	if bps > pb {
-		return tooDamnFast
-	} else if bps > tb {
-		return fmt.Sprintf("%.02f Tbits/s %.02f TBytes/s", float64(bps)/float64(tb), float64(bps)/float64(TB))
-	} else if bps > gb {
-		return fmt.Sprintf("%.02f Gbits/s %.02f GBytes/s", float64(bps)/float64(gb), float64(bps)/float64(GB))
-	} else if bps > mb {
-		return fmt.Sprintf("%.02f Mbit/s %.02f MBytes/s", float64(bps)/float64(mb), float64(bps)/float64(MB))
-	} else if bps > kb {
-		return fmt.Sprintf("%.02f Kbits/s  %.02f KBytes/s", float64(bps)/float64(kb), float64(bps)/float64(KB))
-	}
-	return fmt.Sprintf("%d bps", bps)
+	return DefaultSpeedFormat.Format(bps)
+}
+
+// Format formats a speed given in bits per second
+func (sf SpeedFormat) Format(bps uint64) string {
+	v := float64(bps)
+	unit := "bit/s"
+	if sf.Bytes {
+		v /= bits
+		unit = "B/s"
+	}
+	return sf.scale(v, unit, !sf.Bytes)
+}
+
+// Size formats a byte count with the unit system and precision, auto scaling
+// even when the speed prefix is fixed
+func (sf SpeedFormat) Size(n uint64) string {
+	sf.Prefix = ""
+	return sf.scale(float64(n), "B", false)
+}
+
+// scale formats v with the largest prefix that fits, or the fixed prefix
+func (sf SpeedFormat) scale(v float64, unit string, whole bool) string {
+	base, prefixes := sf.base()
+	i := 0
+	if sf.Prefix != "" {
+		for i = len(prefixes) - 1; i > 0 && prefixes[i] != sf.Prefix; i-- {
+		}
+	} else {
+		for i < len(prefixes)-1 && v >= math.Pow(base, float64(i+1)) {
+			i++
+		}
+	}
+	prec := sf.Precision
+	if prec < 0 {
+		prec = 0
+	}
+	if i == 0 && sf.Prefix == "" && whole {
+		//there are no fractional bits
+		prec = 0
+	}
+	return fmt.Sprintf("%.*f %s%s", prec, v/math.Pow(base, float64(i)), prefixes[i], unit)
+}
+
+func (sf SpeedFormat) base() (float64, []string) {
+	if sf.System == IEC {
+		return 1024, iecPrefixes
+	}
+	return 1000, siPrefixes
+}
+
+// String returns the options which ParseSpeedFormat parses back into sf
+func (sf SpeedFormat) String() string {
+	unit := "si,bits"
+	switch {
+	case sf.Prefix != "" && sf.Bytes:
+		unit = sf.Prefix + "B"
+	case sf.Prefix != "":
+		unit = sf.Prefix + "bit"
+	case sf.System == IEC && sf.Bytes:
+		unit = "iec,bytes"
+	case sf.System == IEC:
+		unit = "iec,bits"
+	case sf.Bytes:
+		unit = "si,bytes"
+	}
+	return fmt.Sprintf("%s,%d", unit, sf.Precision)
+}
+
+// ParseSpeedFormat parses a comma separated list of formatting options:
+// a unit system (si or iec), bits or bytes, a fixed unit such as Mbit or MiB,
+// and a number of decimal places.  For example "iec,bytes" or "Mbit,1".
+func ParseSpeedFormat(v string) (SpeedFormat, error) {
+	sf := DefaultSpeedFormat
+	for _, opt := range strings.Split(v, ",") {
+		opt = strings.TrimSpace(opt)
+		switch strings.ToLower(opt) {
+		case "si":
+			sf.System = SI
+			continue
+		case "iec":
+			sf.System = IEC
+			continue
+		case "bits":
+			sf.Bytes = false
+			continue
+		case "bytes":
+			sf.Bytes = true
+			continue
+		}
+		if p, err := strconv.Atoi(opt); err == nil && p >= 0 {
+			sf.Precision = p
+			continue
+		}
+		prefix, sys, bytes, ok := parseUnit(opt)
+		if !ok || opt == "" {
+			return sf, fmt.Errorf("invalid unit option %q", opt)
+		}
+		sf.Prefix, sf.System, sf.Bytes = prefix, sys, bytes
+	}
+	return sf, nil
+}
+
+// ParseSpeed parses a speed into bits per second.  The unit is optional and defaults to
+// bits, prefixes are SI unless binary, so "100M", "100Mbps", "12.5MB/s" and "95.4Mibit/s"
+// are all 100 million bits per second.
+func ParseSpeed(v string) (uint64, error) {
+	s := strings.TrimSpace(v)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%w %q", errInvalidSpeed, v)
+	}
+	prefix, sys, bytes, ok := parseUnit(unit)
+	if !ok {
+		return 0, fmt.Errorf("%w %q", errInvalidSpeed, v)
+	}
+	sf := SpeedFormat{System: sys}
+	base, prefixes := sf.base()
+	for i := range prefixes {
+		if prefixes[i] == prefix {
+			f *= math.Pow(base, float64(i))
+		}
+	}
+	if bytes {
+		f *= bits
+	}
+	if f >= math.MaxUint64 {
+		return 0, fmt.Errorf("%w %q", errInvalidSpeed, v)
+	}
+	return uint64(f), nil
+}
+
+// parseUnit splits a unit such as "Mbit/s", "MiB" or "k" into its prefix, the unit system
+// and whether it is bytes.  Prefixes are case insensitive, a capital B means bytes.
+func parseUnit(u string) (prefix string, sys UnitSystem, bytes, ok bool) {
+	for _, suffix := range []string{"/s", "ps"} {
+		if strings.HasSuffix(u, suffix) {
+			u = strings.TrimSuffix(u, suffix)
+			break
+		}
+	}
+	switch {
+	case strings.HasSuffix(strings.ToLower(u), "bits"):
+		u = u[:len(u)-4]
+	case strings.HasSuffix(strings.ToLower(u), "bit"):
+		u = u[:len(u)-3]
+	case strings.HasSuffix(strings.ToLower(u), "bytes"):
+		u, bytes = u[:len(u)-5], true
+	case strings.HasSuffix(strings.ToLower(u), "byte"):
+		u, bytes = u[:len(u)-4], true
+	case strings.HasSuffix(u, "B"):
+		u, bytes = u[:len(u)-1], true
+	case strings.HasSuffix(u, "b"):
+		u = u[:len(u)-1]
+	}
+	if strings.HasSuffix(strings.ToLower(u), "i") {
+		sys = IEC
+		u = u[:len(u)-1]
+	}
+	if u == "" {
+		return "", sys, bytes, sys == SI
+	}
+	if len(u) != 1 {
+		return
+	}
+	for i, p := range siPrefixes[1:] {
+		if strings.EqualFold(p, u) {
+			if sys == IEC {
+				return iecPrefixes[i+1], sys, bytes, true
+			}
+			return p, sys, bytes, true
+		}
+	}
+	return
 }
@@ -0,0 +1,210 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+// ServerIndex is a k-d tree over server locations for fast nearest server queries.
+// Locations are mapped onto the unit sphere so straight line (chord) distances
+// order the same way as great circle distances.
+type ServerIndex struct {
+	servers []Testserver
+	nodes   []kdNode
+	root    int
+}
+
+type kdNode struct {
+	p           [3]float64
+	srv         int //index into servers
+	axis        int
+	left, right int //child node indexes, -1 if none
+}
+
+// NewServerIndex builds a spatial index over a copy of servers
+func NewServerIndex(servers []Testserver) *ServerIndex {
+	si := &ServerIndex{
+		servers: append([]Testserver(nil), servers...),
+		nodes:   make([]kdNode, 0, len(servers)),
+	}
+	pts := make([]kdNode, len(servers))
+	for i := range servers {
+		pts[i] = kdNode{p: toUnitVector(servers[i].Lat, servers[i].Long), srv: i}
+	}
+	si.root = si.build(pts, 0)
+	return si
+}
+
+// Len returns the number of servers in the index
+func (si *ServerIndex) Len() int {
+	return len(si.servers)
+}
+
+// Nearest returns up to k servers closest to lat/long, closest first,
+// with the Distance of each set relative to lat/long
+func (si *ServerIndex) Nearest(lat, long float64, k int) []Testserver {
+	if k <= 0 || si.root < 0 {
+		return nil
+	}
+	q := toUnitVector(lat, long)
+	h := &kdHeap{}
+	si.nearest(si.root, q, k, h)
+	res := make([]Testserver, h.Len())
+	for i := len(res) - 1; i >= 0; i-- {
+		c := heap.Pop(h).(kdCandidate)
+		res[i] = si.servers[c.srv]
+		res[i].Distance = chordToKm(c.d2)
+	}
+	return res
+}
+
+// WithinRadius returns all servers within km of lat/long, closest first,
+// with the Distance of each set relative to lat/long
+func (si *ServerIndex) WithinRadius(lat, long, km float64) []Testserver {
+	if km < 0 || si.root < 0 {
+		return nil
+	}
+	//convert the surface distance into a squared chord length
+	theta := km / geo.EARTH_RADIUS
+	if theta > math.Pi {
+		theta = math.Pi
+	}
+	c := 2 * math.Sin(theta/2)
+	var found []kdCandidate
+	si.within(si.root, toUnitVector(lat, long), c*c, &found)
+	sort.Slice(found, func(i, j int) bool { return found[i].d2 < found[j].d2 })
+	res := make([]Testserver, len(found))
+	for i := range found {
+		res[i] = si.servers[found[i].srv]
+		res[i].Distance = chordToKm(found[i].d2)
+	}
+	return res
+}
+
+// build recursively splits pts on the median of each axis in turn, returning the root node index
+func (si *ServerIndex) build(pts []kdNode, depth int) int {
+	if len(pts) == 0 {
+		return -1
+	}
+	axis := depth % 3
+	sort.Slice(pts, func(i, j int) bool { return pts[i].p[axis] < pts[j].p[axis] })
+	mid := len(pts) / 2
+	n := pts[mid]
+	n.axis = axis
+	idx := len(si.nodes)
+	si.nodes = append(si.nodes, n)
+	left := si.build(pts[:mid], depth+1)
+	right := si.build(pts[mid+1:], depth+1)
+	si.nodes[idx].left = left
+	si.nodes[idx].right = right
+	return idx
+}
+
+func (si *ServerIndex) nearest(idx int, q [3]float64, k int, h *kdHeap) {
+	if idx < 0 {
+		return
+	}
+	n := &si.nodes[idx]
+	d2 := dist2(n.p, q)
+	if h.Len() < k {
+		heap.Push(h, kdCandidate{srv: n.srv, d2: d2})
+	} else if d2 < (*h)[0].d2 {
+		(*h)[0] = kdCandidate{srv: n.srv, d2: d2}
+		heap.Fix(h, 0)
+	}
+	diff := q[n.axis] - n.p[n.axis]
+	near, far := n.left, n.right
+	if diff > 0 {
+		near, far = far, near
+	}
+	si.nearest(near, q, k, h)
+	//only cross the splitting plane if it is closer than our worst candidate
+	if h.Len() < k || diff*diff < (*h)[0].d2 {
+		si.nearest(far, q, k, h)
+	}
+}
+
+func (si *ServerIndex) within(idx int, q [3]float64, r2 float64, found *[]kdCandidate) {
+	if idx < 0 {
+		return
+	}
+	n := &si.nodes[idx]
+	if d2 := dist2(n.p, q); d2 <= r2 {
+		*found = append(*found, kdCandidate{srv: n.srv, d2: d2})
+	}
+	diff := q[n.axis] - n.p[n.axis]
+	if diff <= 0 || diff*diff <= r2 {
+		si.within(n.left, q, r2, found)
+	}
+	if diff >= 0 || diff*diff <= r2 {
+		si.within(n.right, q, r2, found)
+	}
+}
+
+func toUnitVector(lat, long float64) [3]float64 {
+	la := lat * math.Pi / 180
+	lo := long * math.Pi / 180
+	return [3]float64{
+		math.Cos(la) * math.Cos(lo),
+		math.Cos(la) * math.Sin(lo),
+		math.Sin(la),
+	}
+}
+
+func dist2(a, b [3]float64) float64 {
+	x, y, z := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return x*x + y*y + z*z
+}
+
+// chordToKm converts a squared chord length on the unit sphere to a great circle distance
+func chordToKm(d2 float64) float64 {
+	c := math.Sqrt(d2) / 2
+	if c > 1 {
+		c = 1
+	}
+	return 2 * math.Asin(c) * geo.EARTH_RADIUS
+}
+
+type kdCandidate struct {
+	srv int
+	d2  float64
+}
+
+// kdHeap is a max heap on distance so the worst of the k best is on top
+type kdHeap []kdCandidate
+
+func (h kdHeap) Len() int            { return len(h) }
+func (h kdHeap) Less(i, j int) bool  { return h[i].d2 > h[j].d2 }
+func (h kdHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *kdHeap) Push(x interface{}) { *h = append(*h, x.(kdCandidate)) }
+func (h *kdHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyStats summarizes a set of latency samples
+type LatencyStats struct {
+	Samples []time.Duration //in the order they were taken
+	Min     time.Duration
+	Max     time.Duration
+	Avg     time.Duration
+	Median  time.Duration
+	Jitter  time.Duration //mean difference between consecutive samples
+}
+
+// NewLatencyStats computes the statistics of samples, which are left unmodified
+func NewLatencyStats(samples []time.Duration) LatencyStats {
+	ls := LatencyStats{Samples: samples}
+	if len(samples) == 0 {
+		return ls
+	}
+	var total time.Duration
+	for i, d := range samples {
+		total += d
+		if d < ls.Min || i == 0 {
+			ls.Min = d
+		}
+		if d > ls.Max {
+			ls.Max = d
+		}
+		if i > 0 {
+			diff := d - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			ls.Jitter += diff
+		}
+	}
+	ls.Avg = total / time.Duration(len(samples))
+	if len(samples) > 1 {
+		ls.Jitter /= time.Duration(len(samples) - 1)
+	}
+	sorted := append(durations(nil), samples...)
+	sort.Sort(sorted)
+	ls.Median = sorted[len(sorted)/2]
+	return ls
+}
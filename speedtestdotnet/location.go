@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kellydunn/golang-geo"
+
+	_ "embed"
+)
+
+// gazetteerData is a small offline list of major cities and their coordinates
+//
+//go:embed gazetteer.csv
+var gazetteerData []byte
+
+var (
+	errInvalidLocation = errors.New("Invalid lat/long")
+
+	gazetteerOnce sync.Once
+	gazetteer     []city
+	gazetteerErr  error
+)
+
+type city struct {
+	name string
+	cc   string
+	lat  float64
+	long float64
+}
+
+// SetLocation overrides the client location, recomputing the distance to
+// every server and re-sorting the servers by distance
+func (c *Config) SetLocation(lat, long float64) error {
+	if lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return errInvalidLocation
+	}
+	c.Lat, c.Long = lat, long
+	p := geo.NewPoint(lat, long)
+	for i := range c.Servers {
+		sp := geo.NewPoint(c.Servers[i].Lat, c.Servers[i].Long)
+		c.Servers[i].Distance = p.GreatCircleDistance(sp)
+	}
+	sort.Sort(testServerlist(c.Servers))
+	return nil
+}
+
+// LookupCity resolves a city name to a lat/long using the built-in gazetteer.
+// The name may be qualified with a country code, e.g. "Portland, US".
+func LookupCity(name string) (lat, long float64, err error) {
+	gazetteerOnce.Do(loadGazetteer)
+	if gazetteerErr != nil {
+		return 0, 0, gazetteerErr
+	}
+	orig, cc := name, ""
+	if idx := strings.LastIndex(name, ","); idx >= 0 {
+		cc = strings.TrimSpace(name[idx+1:])
+		name = name[:idx]
+	}
+	name = strings.TrimSpace(name)
+	for _, c := range gazetteer {
+		if !strings.EqualFold(c.name, name) {
+			continue
+		}
+		if cc != "" && !strings.EqualFold(c.cc, cc) {
+			continue
+		}
+		return c.lat, c.long, nil
+	}
+	return 0, 0, fmt.Errorf("Unknown city %q", orig)
+}
+
+func loadGazetteer() {
+	rdr := csv.NewReader(bytes.NewReader(gazetteerData))
+	rdr.Comment = '#'
+	rdr.FieldsPerRecord = 4
+	recs, err := rdr.ReadAll()
+	if err != nil {
+		gazetteerErr = err
+		return
+	}
+	for _, rec := range recs {
+		c := city{name: rec[0], cc: rec[1]}
+		if c.lat, err = strconv.ParseFloat(rec[2], 64); err != nil {
+			gazetteerErr = err
+			return
+		}
+		if c.long, err = strconv.ParseFloat(rec[3], 64); err != nil {
+			gazetteerErr = err
+			return
+		}
+		gazetteer = append(gazetteer, c)
+	}
+}
@@ -0,0 +1,199 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPlanPingCount = 20
+	defaultPlanDuration  = 3
+)
+
+// Phase is a single stage of a test
+type Phase string
+
+const (
+	PhaseLatency  Phase = "latency"
+	PhaseDownload Phase = "download"
+	PhaseUpload   Phase = "upload"
+)
+
+var (
+	// AllPhases lists every phase in the order they are run
+	AllPhases = []Phase{PhaseLatency, PhaseDownload, PhaseUpload}
+
+	errEmptyPlan = errors.New("Test plan has no phases enabled")
+)
+
+// TestPlan selects which phases of a test are run and how
+type TestPlan struct {
+	Latency   bool
+	Download  bool
+	Upload    bool
+	PingCount int    //number of pings in the latency phase
+	Duration  int    //target duration of each bandwidth phase in seconds
+	Interface string //optional interface to run the bandwidth phases on
+
+	//Report, if set, is called after each phase completes
+	Report func(Phase, *Result)
+	//Progress, if set, is called periodically during the bandwidth phases
+	Progress ProgressFunc
+	//LoadedLatency measures latency on a second connection during the bandwidth phases
+	LoadedLatency bool
+	//Cancel, if set, stops the test with ErrCanceled when closed
+	Cancel <-chan struct{}
+}
+
+// Result holds the outcome of a test, phases that did not run are nil
+type Result struct {
+	Start     time.Time
+	End       time.Time
+	Server    Testserver
+	Interface string
+	Latency   *LatencyStats
+	Download  *Transfer
+	Upload    *Transfer
+}
+
+// NewTestPlan returns a plan which runs every phase with the default settings
+func NewTestPlan() TestPlan {
+	return TestPlan{
+		Latency:   true,
+		Download:  true,
+		Upload:    true,
+		PingCount: defaultPlanPingCount,
+		Duration:  defaultPlanDuration,
+	}
+}
+
+// ParsePhases enables only the phases named in a comma separated list
+func (tp *TestPlan) ParsePhases(v string) error {
+	tp.Latency, tp.Download, tp.Upload = false, false, false
+	for _, p := range strings.Split(v, ",") {
+		switch Phase(strings.ToLower(strings.TrimSpace(p))) {
+		case PhaseLatency, "ping":
+			tp.Latency = true
+		case PhaseDownload, "down":
+			tp.Download = true
+		case PhaseUpload, "up":
+			tp.Upload = true
+		default:
+			return fmt.Errorf("Unknown test phase %q", p)
+		}
+	}
+	return nil
+}
+
+// Phases returns the phases the plan will run
+func (tp TestPlan) Phases() []Phase {
+	var ps []Phase
+	if tp.Latency {
+		ps = append(ps, PhaseLatency)
+	}
+	if tp.Download {
+		ps = append(ps, PhaseDownload)
+	}
+	if tp.Upload {
+		ps = append(ps, PhaseUpload)
+	}
+	return ps
+}
+
+// Phases returns the phases which completed
+func (r *Result) Phases() []Phase {
+	var ps []Phase
+	if r.Latency != nil {
+		ps = append(ps, PhaseLatency)
+	}
+	if r.Download != nil {
+		ps = append(ps, PhaseDownload)
+	}
+	if r.Upload != nil {
+		ps = append(ps, PhaseUpload)
+	}
+	return ps
+}
+
+// Run executes the phases of a test plan in order, stopping at the first failure.
+// The result is always returned so the phases completed before a failure are available.
+func (ts *Testserver) Run(tp TestPlan) (*Result, error) {
+	res := &Result{
+		Start:     time.Now(),
+		Server:    *ts,
+		Interface: tp.Interface,
+	}
+	defer func() {
+		res.End = time.Now()
+	}()
+	if !tp.Latency && !tp.Download && !tp.Upload {
+		return res, errEmptyPlan
+	}
+	xo := transferOptions{
+		progress: tp.Progress,
+		cancel:   tp.Cancel,
+		loaded:   tp.LoadedLatency,
+	}
+	if tp.Latency {
+		durs, err := ts.ping(tp.PingCount, tp.Cancel)
+		if err != nil {
+			return res, err
+		}
+		ls := NewLatencyStats(durs)
+		res.Latency = &ls
+		tp.report(PhaseLatency, res)
+	}
+	if tp.Download {
+		if canceled(tp.Cancel) {
+			return res, ErrCanceled
+		}
+		xfer, err := ts.downstream(tp.Duration, tp.Interface, xo)
+		if err != nil {
+			return res, err
+		}
+		res.Download = &xfer
+		tp.report(PhaseDownload, res)
+	}
+	if tp.Upload {
+		if canceled(tp.Cancel) {
+			return res, ErrCanceled
+		}
+		xfer, err := ts.upstream(tp.Duration, tp.Interface, xo)
+		if err != nil {
+			return res, err
+		}
+		res.Upload = &xfer
+		tp.report(PhaseUpload, res)
+	}
+	return res, nil
+}
+
+func (tp TestPlan) report(p Phase, res *Result) {
+	if tp.Report != nil {
+		tp.Report(p, res)
+	}
+}
@@ -0,0 +1,170 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeCandidates = 10
+	defaultProbeWorkers    = 4
+	defaultProbeCount      = 5
+	defaultProbeDeadline   = 10 * time.Second
+)
+
+// ProbeConfig controls a concurrent latency probe across candidate servers
+type ProbeConfig struct {
+	Candidates int           //number of servers, from the front of the list, to probe
+	Workers    int           //maximum number of servers probed at once
+	Count      int           //number of pings sent to each server
+	Deadline   time.Duration //shared deadline for the entire probe
+}
+
+// ProbeResult holds the latency statistics gathered from a single server
+type ProbeResult struct {
+	Server  *Testserver
+	Samples []time.Duration //successful ping times, in the order they were taken
+	Latency time.Duration   //median latency
+	Jitter  time.Duration   //mean difference between consecutive samples
+	Loss    float64         //fraction of pings that failed, 0.0 - 1.0
+	Err     error           //set when no ping succeeded
+	Score   float64         //selection score assigned by RankServers, lower is better
+}
+
+// ProbeServers pings the first Candidates servers concurrently and returns the
+// results ranked by latency.  Servers which did not respond are placed at the end.
+// The median latency of each responding server is stored in the server structure.
+func ProbeServers(servers []Testserver, pc ProbeConfig) []ProbeResult {
+	if pc.Candidates <= 0 {
+		pc.Candidates = defaultProbeCandidates
+	}
+	if pc.Workers <= 0 {
+		pc.Workers = defaultProbeWorkers
+	}
+	if pc.Count <= 0 {
+		pc.Count = defaultProbeCount
+	}
+	if pc.Count > latencyMaxTestCount {
+		pc.Count = latencyMaxTestCount
+	}
+	if pc.Deadline <= 0 {
+		pc.Deadline = defaultProbeDeadline
+	}
+	if pc.Candidates > len(servers) {
+		pc.Candidates = len(servers)
+	}
+	deadline := time.Now().Add(pc.Deadline)
+	results := make([]ProbeResult, pc.Candidates)
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < pc.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				results[idx] = servers[idx].probe(pc.Count, deadline)
+			}
+		}()
+	}
+	for i := range results {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	sort.Stable(probeResults(results))
+	return results
+}
+
+// probe sends count pings to the server, tolerating individual failures so that
+// loss can be measured.  A failed ping poisons the connection, so we redial.
+func (ts *Testserver) probe(count int, deadline time.Time) ProbeResult {
+	pr := ProbeResult{Server: ts}
+	buff := make([]byte, 256)
+	var conn net.Conn
+	var lost int
+	for i := 0; i < count; i++ {
+		if time.Now().After(deadline) {
+			lost += count - i
+			break
+		}
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", ts.Host, minTimeout(pingTimeout, deadline))
+			if err != nil {
+				lost += count - i
+				break
+			}
+			conn = c
+		}
+		d, err := pingOnce(conn, buff, time.Now().Add(minTimeout(pingTimeout, deadline)))
+		if err != nil {
+			lost++
+			conn.Close()
+			conn = nil
+			continue
+		}
+		pr.Samples = append(pr.Samples, d)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	pr.Loss = float64(lost) / float64(count)
+	if len(pr.Samples) == 0 {
+		pr.Err = ErrTimeout
+		return pr
+	}
+	ls := NewLatencyStats(pr.Samples)
+	pr.Latency = ls.Median
+	pr.Jitter = ls.Jitter
+	ts.Latency = pr.Latency
+	return pr
+}
+
+// minTimeout returns the smaller of d and the time remaining until deadline
+func minTimeout(d time.Duration, deadline time.Time) time.Duration {
+	rem := time.Until(deadline)
+	if rem <= 0 {
+		return time.Millisecond
+	}
+	if rem < d {
+		return rem
+	}
+	return d
+}
+
+type probeResults []ProbeResult
+
+func (p probeResults) Len() int      { return len(p) }
+func (p probeResults) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p probeResults) Less(i, j int) bool {
+	if (p[i].Err == nil) != (p[j].Err == nil) {
+		return p[i].Err == nil
+	}
+	if p[i].Latency != p[j].Latency {
+		return p[i].Latency < p[j].Latency
+	}
+	return p[i].Loss < p[j].Loss
+}
@@ -0,0 +1,270 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ProgressInterval is how often progress is reported during a bandwidth test
+	ProgressInterval = 250 * time.Millisecond
+	// LoadedPingInterval is the time between latency samples taken during a bandwidth test
+	LoadedPingInterval = 500 * time.Millisecond
+)
+
+// Progress is a snapshot of a bandwidth test in flight
+type Progress struct {
+	Phase   Phase
+	Bytes   uint64        //bytes moved so far
+	Elapsed time.Duration //time since the test started
+	Bps     uint64        //rate over the most recent interval
+	Latency time.Duration //most recent loaded latency sample, zero when not measured
+}
+
+// ProgressFunc receives progress reports, it is called on the testing goroutine
+// so it should return quickly
+type ProgressFunc func(Progress)
+
+// transferOptions are the optional extras of a bandwidth test
+type transferOptions struct {
+	progress ProgressFunc
+	cancel   <-chan struct{}
+	loaded   bool //measure latency on a second connection while the transfer runs
+}
+
+// transfer tracks the extras of a bandwidth test in flight
+type transfer struct {
+	transferOptions
+	stop   func()
+	pinger *loadedPinger
+}
+
+// start begins watching for cancellation of conn and the loaded latency test against host
+func (xo transferOptions) start(conn net.Conn, host string) *transfer {
+	tr := &transfer{
+		transferOptions: xo,
+		stop:            closeOnCancel(conn, xo.cancel),
+	}
+	if xo.loaded {
+		tr.pinger = startLoadedPing(host)
+	}
+	return tr
+}
+
+// finish stops the extras, attaching the loaded latency to xfer and
+// reporting a failure caused by cancellation as ErrCanceled
+func (tr *transfer) finish(xfer *Transfer, err *error) {
+	tr.stop()
+	samples := tr.pinger.stop()
+	if *err != nil {
+		if canceled(tr.cancel) {
+			*err = ErrCanceled
+		}
+		return
+	}
+	if len(samples) > 0 {
+		ls := NewLatencyStats(samples)
+		xfer.Loaded = &ls
+	}
+}
+
+// closeOnCancel closes conn if cancel is closed before the returned function is called
+func closeOnCancel(conn net.Conn, cancel <-chan struct{}) func() {
+	if cancel == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func canceled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadedPinger pings a server on its own connection while a transfer saturates the link
+type loadedPinger struct {
+	mtx     sync.Mutex
+	conn    net.Conn
+	samples []time.Duration
+	done    chan struct{}
+}
+
+func startLoadedPing(host string) *loadedPinger {
+	lp := &loadedPinger{done: make(chan struct{})}
+	go lp.run(host)
+	return lp
+}
+
+func (lp *loadedPinger) run(host string) {
+	buff := make([]byte, 256)
+	tkr := time.NewTicker(LoadedPingInterval)
+	defer tkr.Stop()
+	for {
+		if conn := lp.dial(host); conn != nil {
+			d, err := pingOnce(conn, buff, time.Now().Add(pingTimeout))
+			lp.mtx.Lock()
+			if lp.stopped() {
+				lp.mtx.Unlock()
+				return
+			}
+			if err != nil {
+				//a failed ping poisons the connection, redial on the next tick
+				conn.Close()
+				lp.conn = nil
+			} else {
+				lp.samples = append(lp.samples, d)
+			}
+			lp.mtx.Unlock()
+		}
+		select {
+		case <-lp.done:
+			return
+		case <-tkr.C:
+		}
+	}
+}
+
+// dial returns the ping connection, connecting if needed, or nil once stopped
+func (lp *loadedPinger) dial(host string) net.Conn {
+	lp.mtx.Lock()
+	conn := lp.conn
+	lp.mtx.Unlock()
+	if conn != nil {
+		return conn
+	}
+	conn, err := net.DialTimeout("tcp", host, pingTimeout)
+	if err != nil {
+		return nil
+	}
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+	if lp.stopped() {
+		conn.Close()
+		return nil
+	}
+	lp.conn = conn
+	return conn
+}
+
+func (lp *loadedPinger) stopped() bool {
+	return canceled(lp.done)
+}
+
+// latest returns the most recent sample
+func (lp *loadedPinger) latest() time.Duration {
+	if lp == nil {
+		return 0
+	}
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+	if len(lp.samples) == 0 {
+		return 0
+	}
+	return lp.samples[len(lp.samples)-1]
+}
+
+// stop ends the test, abandoning any ping in flight, and returns the samples
+func (lp *loadedPinger) stop() []time.Duration {
+	if lp == nil {
+		return nil
+	}
+	lp.mtx.Lock()
+	defer lp.mtx.Unlock()
+	close(lp.done)
+	if lp.conn != nil {
+		lp.conn.Close()
+		lp.conn = nil
+	}
+	return lp.samples
+}
+
+// meter counts the bytes moving through a connection and reports progress
+type meter struct {
+	rw        io.ReadWriter
+	tr        *transfer
+	phase     Phase
+	start     time.Time
+	last      time.Time
+	bytes     uint64
+	lastBytes uint64
+}
+
+// newMeter wraps a connection with progress reporting, or returns it as is when not wanted
+func newMeter(rw io.ReadWriter, phase Phase, tr *transfer) io.ReadWriter {
+	if tr.progress == nil {
+		return rw
+	}
+	now := time.Now()
+	return &meter{
+		rw:    rw,
+		tr:    tr,
+		phase: phase,
+		start: now,
+		last:  now,
+	}
+}
+
+func (m *meter) Read(b []byte) (int, error) {
+	n, err := m.rw.Read(b)
+	m.add(n)
+	return n, err
+}
+
+func (m *meter) Write(b []byte) (int, error) {
+	n, err := m.rw.Write(b)
+	m.add(n)
+	return n, err
+}
+
+func (m *meter) add(n int) {
+	m.bytes += uint64(n)
+	now := time.Now()
+	d := now.Sub(m.last)
+	if d < ProgressInterval {
+		return
+	}
+	m.tr.progress(Progress{
+		Phase:   m.phase,
+		Bytes:   m.bytes,
+		Elapsed: now.Sub(m.start),
+		Bps:     bps(m.bytes-m.lastBytes, d),
+		Latency: m.tr.pinger.latest(),
+	})
+	m.last, m.lastBytes = now, m.bytes
+}
@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+var (
+	errUnknownListFormat = errors.New("Unknown server list format")
+	errEmptyServerList   = errors.New("Empty server list")
+)
+
+// jsonServer is a server in the JSON listing, numeric fields may be quoted
+type jsonServer struct {
+	Url      string      `json:"url"`
+	Lat      json.Number `json:"lat"`
+	Long     json.Number `json:"lon"`
+	Distance json.Number `json:"distance"`
+	Name     string      `json:"name"`
+	Country  string      `json:"country"`
+	CC       string      `json:"cc"`
+	Sponsor  string      `json:"sponsor"`
+	ID       json.Number `json:"id"`
+	Host     string      `json:"host"`
+}
+
+// decodeServerList picks a parser using the content type, sniffing the body
+// when the content type is missing or generic
+func decodeServerList(contentType string, rdr io.Reader) ([]server, error) {
+	br := bufio.NewReader(rdr)
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasSuffix(mt, "json"):
+		return decodeJSONServers(br)
+	case strings.HasSuffix(mt, "xml"):
+		return decodeXMLServers(br)
+	}
+	//skip leading whitespace and look at the first real byte
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[', '{':
+			return decodeJSONServers(br)
+		case '<':
+			return decodeXMLServers(br)
+		}
+		return nil, errUnknownListFormat
+	}
+}
+
+func decodeXMLServers(rdr io.Reader) ([]server, error) {
+	sts := settings{}
+	if err := xml.NewDecoder(rdr).Decode(&sts); err != nil {
+		return nil, err
+	}
+	if len(sts.Servers) == 0 {
+		return nil, errEmptyServerList
+	}
+	return sts.Servers, nil
+}
+
+func decodeJSONServers(rdr io.Reader) ([]server, error) {
+	var jss []jsonServer
+	if err := json.NewDecoder(rdr).Decode(&jss); err != nil {
+		return nil, err
+	}
+	if len(jss) == 0 {
+		return nil, errEmptyServerList
+	}
+	srvs := make([]server, 0, len(jss))
+	for i := range jss {
+		srv, err := jss[i].server()
+		if err != nil {
+			return nil, err
+		}
+		srvs = append(srvs, srv)
+	}
+	return srvs, nil
+}
+
+// server converts a JSON listing entry into the native structure
+func (js jsonServer) server() (server, error) {
+	srv := server{
+		Url:     js.Url,
+		Name:    js.Name,
+		Country: js.Country,
+		CC:      js.CC,
+		Sponsor: js.Sponsor,
+		Host:    js.Host,
+	}
+	id, err := strconv.ParseUint(js.ID.String(), 10, 32)
+	if err != nil {
+		return srv, err
+	}
+	srv.ID = uint(id)
+	if srv.Lat, err = js.Lat.Float64(); err != nil {
+		return srv, err
+	}
+	if srv.Long, err = js.Long.Float64(); err != nil {
+		return srv, err
+	}
+	if js.Distance != "" {
+		if srv.Distance, err = js.Distance.Float64(); err != nil {
+			return srv, err
+		}
+	}
+	return srv, nil
+}
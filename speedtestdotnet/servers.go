@@ -25,10 +25,8 @@ package speedtestdotnet
 import (
 	"encoding/xml"
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
-	"net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -38,15 +36,18 @@ import (
 )
 
 const (
-	serversConfigUrl string        = `http://www.speedtest.net/speedtest-servers-static.php?x=whysosad`
-	clientConfigUrl  string        = `http://www.speedtest.net/speedtest-config.php`
+	serversConfigUrl string        = `https://www.speedtest.net/speedtest-servers-static.php?x=whysosad`
+	serversJSONUrl   string        = `https://www.speedtest.net/api/js/servers?engine=js&limit=100`
+	clientConfigUrl  string        = `https://www.speedtest.net/speedtest-config.php`
 	getTimeout       time.Duration = 2 * time.Second
 )
 
 type Testserver struct {
+	ID       uint
 	Name     string
 	Sponsor  string
 	Country  string
+	CC       string //country code
 	Lat      float64
 	Long     float64
 	Distance float64 //distance from server in KM
@@ -62,6 +63,9 @@ type Config struct {
 	Lat        float64
 	Long       float64
 	ISP        string
+	Country    string //country code
+	ISPDlAvg   uint64 //average download speed of clients on our ISP in bps, zero if unknown
+	ISPUpAvg   uint64 //average upload speed of clients on our ISP in bps, zero if unknown
 	Servers    []Testserver
 }
 
@@ -77,8 +81,9 @@ type cconfig struct {
 	Lat      float64  `xml:"lat,attr"`
 	Long     float64  `xml:"lon,attr"`
 	ISP      string   `xml:"isp,attr"`
-	ISPUpAvg uint     `xml:"ispulavg,attr"`
-	ISPDlAvg uint     `xml:"ispdlavg,attr"`
+	Country  string   `xml:"country,attr"`
+	ISPUpAvg uint     `xml:"ispulavg,attr"` //Kbps
+	ISPDlAvg uint     `xml:"ispdlavg,attr"` //Kbps
 }
 
 type speedtestConfig struct {
@@ -91,7 +96,7 @@ type speedtestConfig struct {
 type server struct {
 	XMLName xml.Name `xml:"server"`
 	Url     string   `xml:"url,attr"`
-	Url2    string   `xml:"url2,attr"`
+	Url2    string   `xml:"url2,attr,omitempty"`
 	Lat     float64  `xml:"lat,attr"`
 	Long    float64  `xml:"lon,attr"`
 	Name    string   `xml:"name,attr"`
@@ -100,6 +105,8 @@ type server struct {
 	Sponsor string   `xml:"sponsor,attr"`
 	ID      uint     `xml:"id,attr"`
 	Host    string   `xml:"host,attr"`
+
+	Distance float64 `xml:"-"` //distance in km as reported by the JSON listing
 }
 
 type settings struct {
@@ -108,63 +115,51 @@ type settings struct {
 }
 
 // GetServerList returns a list of servers in the native speedtest.net structure
+// using the default client
 func GetServerList() ([]server, error) {
-	//get a list of servers
-	clnt := http.Client{
-		Timeout: getTimeout,
-	}
-	//get the server configs
-	req, err := http.NewRequest("GET", serversConfigUrl, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.1; WOW64; rv:40.0) Gecko/20100101 Firefox/40.1")
-	resp, err := clnt.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	return NewClient().GetServerList()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		x, _ := ioutil.ReadAll(resp.Body)
-		println(string(x))
-		return nil, fmt.Errorf("Invalid status %d", resp.StatusCode)
-	}
-	xmlDec := xml.NewDecoder(resp.Body)
-	sts := settings{}
-	if err := xmlDec.Decode(&sts); err != nil {
-		return nil, err
-	}
-	return sts.Servers, nil
+// GetServerListURL returns the list of servers from a specific endpoint using the default client
+func GetServerListURL(url string) ([]server, error) {
+	return NewClient().GetServerListURL(url)
 }
 
-// GetConfig returns a configuration containing information about our client and a list of acceptable servers sorted by distance
+// GetConfig returns a configuration containing information about our client and a list of
+// acceptable servers sorted by distance using the default client
 func GetConfig() (*Config, error) {
-	//get a client configuration
-	clnt := http.Client{
-		Timeout: getTimeout,
-	}
-	//get the server configs
-	req, err := http.NewRequest("GET", clientConfigUrl, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.1; WOW64; rv:40.0) Gecko/20100101 Firefox/40.1")
+	return NewClient().GetConfig()
+}
 
-	resp, err := clnt.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// GetServerList returns a list of servers in the native speedtest.net structure.
+// Each server list URL is tried in order until one succeeds.
+func (c *Client) GetServerList() ([]server, error) {
+	var srvs []server
+	err := c.getFirst(c.ServerURLs, func(contentType string, rdr io.Reader) (err error) {
+		srvs, err = decodeServerList(contentType, rdr)
+		return
+	})
+	return srvs, err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		x, _ := ioutil.ReadAll(resp.Body)
-		println(string(x))
-		return nil, fmt.Errorf("Invalid status %d", resp.StatusCode)
-	}
-	xmlDec := xml.NewDecoder(resp.Body)
+// GetServerListURL returns the list of servers from a specific endpoint.
+// Either the JSON or XML listing format is accepted, based on the content type.
+func (c *Client) GetServerListURL(url string) ([]server, error) {
+	var srvs []server
+	err := c.get(url, func(contentType string, rdr io.Reader) (err error) {
+		srvs, err = decodeServerList(contentType, rdr)
+		return
+	})
+	return srvs, err
+}
+
+// GetConfig returns a configuration containing information about our client and a list of acceptable servers sorted by distance
+func (c *Client) GetConfig() (*Config, error) {
 	cc := speedtestConfig{}
-	if err := xmlDec.Decode(&cc); err != nil {
+	err := c.getFirst(c.ConfigURLs, func(contentType string, rdr io.Reader) error {
+		return xml.NewDecoder(rdr).Decode(&cc)
+	})
+	if err != nil {
 		return nil, err
 	}
 	cfg := Config{
@@ -173,6 +168,9 @@ func GetConfig() (*Config, error) {
 		Lat:        cc.ClientConfig.Lat,
 		Long:       cc.ClientConfig.Long,
 		ISP:        cc.ClientConfig.ISP,
+		Country:    cc.ClientConfig.Country,
+		ISPDlAvg:   uint64(cc.ClientConfig.ISPDlAvg) * 1000,
+		ISPUpAvg:   uint64(cc.ClientConfig.ISPUpAvg) * 1000,
 	}
 	ignoreIDs := make(map[uint]bool, 1)
 	strIDs := strings.Split(cc.ServerConfig.IgnoreIDs, ",")
@@ -183,7 +181,7 @@ func GetConfig() (*Config, error) {
 		}
 		ignoreIDs[uint(x)] = false
 	}
-	srvs, err := GetServerList()
+	srvs, err := c.GetServerList()
 	if err != nil {
 		return nil, err
 	}
@@ -201,9 +199,11 @@ func populateServers(cfg *Config, srvs []server, ignore map[uint]bool) error {
 			continue
 		}
 		srv := Testserver{
+			ID:      srvs[i].ID,
 			Name:    srvs[i].Name,
 			Sponsor: srvs[i].Sponsor,
 			Country: srvs[i].Country,
+			CC:      srvs[i].CC,
 			Lat:     srvs[i].Lat,
 			Long:    srvs[i].Long,
 			Host:    srvs[i].Host,
@@ -0,0 +1,151 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package speedtestdotnet
+
+//go:generate go run gen_snapshot.go -o snapshot.xml
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	_ "embed"
+)
+
+const (
+	locationCacheFile = "location.json"
+	serverCacheFile   = "servers.xml"
+)
+
+// serverSnapshot is a copy of the server list used when the live list cannot be fetched
+//
+//go:embed snapshot.xml
+var serverSnapshot []byte
+
+// Location is a client location remembered from a previous live configuration
+type Location struct {
+	Lat     float64   `json:"lat"`
+	Long    float64   `json:"lon"`
+	IP      string    `json:"ip,omitempty"`
+	ISP     string    `json:"isp,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// SnapshotServers returns the server list embedded in the binary
+func SnapshotServers() ([]server, error) {
+	return decodeXMLServers(bytes.NewReader(serverSnapshot))
+}
+
+// SnapshotConfig builds a configuration from the embedded server list with
+// distances estimated from the given client location
+func SnapshotConfig(loc Location) (*Config, error) {
+	srvs, err := SnapshotServers()
+	if err != nil {
+		return nil, err
+	}
+	return NewConfig(loc, srvs)
+}
+
+// NewConfig builds a configuration from a server list with distances
+// estimated from the given client location
+func NewConfig(loc Location, srvs []server) (*Config, error) {
+	cfg := Config{
+		IP:   net.ParseIP(loc.IP),
+		Lat:  loc.Lat,
+		Long: loc.Long,
+		ISP:  loc.ISP,
+	}
+	if err := populateServers(&cfg, srvs, nil); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// DefaultServerCachePath returns the cached server list file in the user cache directory
+func DefaultServerCachePath() (string, error) {
+	return cachePath(serverCacheFile)
+}
+
+// LoadServerList reads a server list previously written by WriteSnapshot
+func LoadServerList(path string) ([]server, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	return decodeXMLServers(fin)
+}
+
+// WriteSnapshot writes a server list in the legacy XML format used by the snapshot
+func WriteSnapshot(w io.Writer, srvs []server) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(settings{Servers: srvs}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Location returns the client location of a configuration
+func (c *Config) Location() Location {
+	loc := Location{
+		Lat:     c.Lat,
+		Long:    c.Long,
+		ISP:     c.ISP,
+		Updated: time.Now(),
+	}
+	if c.IP != nil {
+		loc.IP = c.IP.String()
+	}
+	return loc
+}
+
+// DefaultLocationCachePath returns the location cache file in the user cache directory
+func DefaultLocationCachePath() (string, error) {
+	return cachePath(locationCacheFile)
+}
+
+// LoadLocation reads a cached client location
+func LoadLocation(path string) (Location, error) {
+	var loc Location
+	fin, err := os.Open(path)
+	if err != nil {
+		return loc, err
+	}
+	defer fin.Close()
+	err = json.NewDecoder(fin).Decode(&loc)
+	return loc, err
+}
+
+// SaveLocation caches a client location for use when we are offline
+func SaveLocation(path string, loc Location) error {
+	return saveJSON(path, loc)
+}
@@ -0,0 +1,136 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+// thresholds are the assertions a test must pass for a zero exit code
+type thresholds struct {
+	minDownload speed
+	minUpload   speed
+	maxLatency  time.Duration
+}
+
+var limits thresholds
+
+func addThresholdFlags(fs *flag.FlagSet, bandwidth bool) {
+	if bandwidth {
+		fs.Var(&limits.minDownload, "min-download", "Exit with code 1 if the download speed is below this, e.g. 100M")
+		fs.Var(&limits.minUpload, "min-upload", "Exit with code 1 if the upload speed is below this, e.g. 20M")
+	}
+	fs.DurationVar(&limits.maxLatency, "max-latency", 0, "Exit with code 1 if the median latency is above this, e.g. 40ms")
+}
+
+// validate ensures every threshold applies to a phase of the plan
+func (t thresholds) validate(tp stdn.TestPlan) error {
+	switch {
+	case t.minDownload > 0 && !tp.Download:
+		return fmt.Errorf("A download threshold requires the %s phase", stdn.PhaseDownload)
+	case t.minUpload > 0 && !tp.Upload:
+		return fmt.Errorf("An upload threshold requires the %s phase", stdn.PhaseUpload)
+	case t.maxLatency > 0 && !tp.Latency:
+		return fmt.Errorf("A latency threshold requires the %s phase", stdn.PhaseLatency)
+	}
+	return nil
+}
+
+// check returns a description of each threshold the result missed
+func (t thresholds) check(res *stdn.Result) (missed []string) {
+	if t.minDownload > 0 && res.Download != nil && res.Download.Bps < uint64(t.minDownload) {
+		missed = append(missed, fmt.Sprintf("Download %s is below the minimum of %s",
+			humanSpeed(res.Download.Bps), humanSpeed(uint64(t.minDownload))))
+	}
+	if t.minUpload > 0 && res.Upload != nil && res.Upload.Bps < uint64(t.minUpload) {
+		missed = append(missed, fmt.Sprintf("Upload %s is below the minimum of %s",
+			humanSpeed(res.Upload.Bps), humanSpeed(uint64(t.minUpload))))
+	}
+	if t.maxLatency > 0 && res.Latency != nil && res.Latency.Median > t.maxLatency {
+		missed = append(missed, fmt.Sprintf("Latency %s is above the maximum of %s",
+			res.Latency.Median, t.maxLatency))
+	}
+	return
+}
+
+// checkThresholds reports any missed thresholds and exits if there were any
+func checkThresholds(res *stdn.Result) {
+	missed := limits.check(res)
+	if len(missed) == 0 {
+		return
+	}
+	for _, m := range missed {
+		fmt.Fprintf(os.Stderr, "%s\n", m)
+	}
+	os.Exit(exitThreshold)
+}
+
+// speed is a flag holding a speed in bits per second
+type speed uint64
+
+// speedFormat is a flag holding the units speeds are printed in
+type speedFormat struct {
+	stdn.SpeedFormat
+}
+
+var units = speedFormat{stdn.DefaultSpeedFormat}
+
+func addUnitsFlag(fs *flag.FlagSet) {
+	fs.Var(&units, "units", "Units for printed speeds: si or iec, bits or bytes, a fixed unit such as Mbit or MiB,\nand decimal places, comma separated, e.g. \"iec,bytes\" or \"Mbit,1\"")
+}
+
+// humanSpeed formats a speed in the units from the command line
+func humanSpeed(bps uint64) string {
+	return units.Format(bps)
+}
+
+func (sf *speedFormat) String() string {
+	return sf.SpeedFormat.String()
+}
+
+func (sf *speedFormat) Set(v string) (err error) {
+	sf.SpeedFormat, err = stdn.ParseSpeedFormat(v)
+	return
+}
+
+func (s *speed) String() string {
+	if *s == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*s), 10)
+}
+
+func (s *speed) Set(v string) error {
+	bps, err := stdn.ParseSpeed(v)
+	if err != nil {
+		return err
+	}
+	*s = speed(bps)
+	return nil
+}
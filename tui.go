@@ -0,0 +1,689 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2014, 2016 traetox
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Bowery/prompt"
+	"github.com/joliv/spark"
+	stdn "github.com/traetox/speedtest/speedtestdotnet"
+)
+
+const (
+	tuiRefresh     = 200 * time.Millisecond
+	tuiMinWidth    = 60
+	tuiMinHeight   = 16
+	tuiMaxChart    = 10 //maximum height of the throughput chart
+	tuiLatencyRows = 3  //height of the loaded latency chart
+
+	enterAltScreen = "\033[?1049h\033[?25l"
+	leaveAltScreen = "\033[?25h\033[?1049l"
+	styleReverse   = "\033[7m"
+	styleBold      = "\033[1m"
+	styleReset     = "\033[0m"
+
+	tuiKeys = " ↑↓ select  enter full test  d download  u upload  p ping  c cancel  r re-probe  q quit"
+)
+
+// tuiTest is a test started from the dashboard
+type tuiTest struct {
+	server   stdn.Testserver
+	phases   []stdn.Phase
+	phase    int //index of the running phase
+	cancel   chan struct{}
+	canceled bool
+	start    time.Time
+	progress *stdn.Progress     //latest progress of the running bandwidth phase
+	idle     *stdn.LatencyStats //result of the latency phase
+	rates    []float64          //throughput samples across the bandwidth phases
+	loaded   []float64          //loaded latency samples in milliseconds
+	res      *stdn.Result
+	err      error
+}
+
+// events sent to the dashboard loop by the test and probe goroutines
+type (
+	progressEvent struct {
+		t *tuiTest
+		p stdn.Progress
+	}
+	phaseEvent struct {
+		t   *tuiTest
+		p   stdn.Phase
+		lat *stdn.LatencyStats
+	}
+	doneEvent struct {
+		t   *tuiTest
+		res *stdn.Result
+		err error
+	}
+	probeEvent []stdn.ProbeResult
+)
+
+// tui is the full screen dashboard, its state is only touched by the loop in run
+type tui struct {
+	cfg     *stdn.Config
+	out     io.Writer
+	events  chan interface{}
+	servers []stdn.ProbeResult
+	sel     int //selected server
+	top     int //first visible server
+	probing bool
+	running *tuiTest
+	last    *tuiTest //most recent test, its charts stay up once it finishes
+	session []*tuiTest
+	status  string
+}
+
+func runTUI(args []string) {
+	fs := findCommand("tui").flagSet()
+	addConfigFlags(fs)
+	addSelectFlags(fs)
+	fs.IntVar(&speedtestDuration, "t", 3, "Target duration for speedtests (in seconds)")
+	fs.StringVar(&interface_id, "I", "", "Select which interface you would like to run the speed test on")
+	addHistoryFlags(fs)
+	addUnitsFlag(fs)
+	parse(fs, args)
+	if speedtestDuration <= 0 {
+		fail(errCodeArgs, errors.New("Invalid test duration"))
+	}
+	if probeCandidates <= 0 {
+		fail(errCodeArgs, errors.New("Invalid probe candidate count"))
+	}
+	if _, _, err := prompt.TerminalSize(os.Stdout); err != nil {
+		fail(errCodeArgs, errors.New("The dashboard requires a terminal"))
+	}
+
+	health = openHealthStore(healthPath)
+	hist = openHistory()
+	cfg := getConfig()
+	servers, err := tuiServers(cfg)
+	if err != nil {
+		fail(errCodeNoServers, err)
+	}
+	term, err := prompt.NewTerminal()
+	if err != nil {
+		fail(errCodeInput, fmt.Errorf("input failure \"%v\"", err))
+	}
+	t := &tui{
+		cfg:    cfg,
+		out:    prompt.NewAnsiWriter(term.Out),
+		events: make(chan interface{}, 16),
+	}
+	fmt.Fprint(t.out, enterAltScreen)
+	t.run(prompt.NewAnsiReader(term.In), servers)
+	fmt.Fprint(t.out, styleReset+leaveAltScreen)
+	term.Close()
+}
+
+// tuiServers returns the servers the dashboard lists, those given with -id or -s or all of them
+func tuiServers(cfg *stdn.Config) ([]stdn.Testserver, error) {
+	if serverID != 0 {
+		srv, err := getServerByID(cfg, serverID)
+		if err != nil {
+			return nil, err
+		}
+		return []stdn.Testserver{srv}, nil
+	}
+	if search != "" {
+		return getSearchServers(cfg, search)
+	}
+	return cfg.Servers, nil
+}
+
+// run is the event loop, redrawing after every event and periodically for resizes
+func (t *tui) run(in io.Reader, servers []stdn.Testserver) {
+	keys := make(chan key)
+	go readKeys(newKeyReader(in), keys)
+	t.probe(servers)
+	tkr := time.NewTicker(tuiRefresh)
+	defer tkr.Stop()
+	for {
+		t.draw()
+		select {
+		case k, ok := <-keys:
+			if !ok || !t.key(k, servers) {
+				t.cancel()
+				return
+			}
+		case ev := <-t.events:
+			t.handle(ev)
+		case <-tkr.C:
+		}
+	}
+}
+
+// key handles a key press, returning false to quit
+func (t *tui) key(k key, servers []stdn.Testserver) bool {
+	t.status = ""
+	switch k {
+	case "q", "Q", keyCtrlC, keyCtrlD:
+		return false
+	case keyUp, "k":
+		t.move(-1)
+	case keyDown, "j":
+		t.move(1)
+	case keyPgUp:
+		t.move(-t.serverRows())
+	case keyPgDn:
+		t.move(t.serverRows())
+	case keyHome, "g":
+		t.move(-len(t.servers))
+	case keyEnd, "G":
+		t.move(len(t.servers))
+	case keyEnter, "t":
+		t.test("latency,download,upload")
+	case "d":
+		t.test("download")
+	case "u":
+		t.test("upload")
+	case "p":
+		t.test("latency")
+	case "c", keyEsc:
+		if t.running == nil {
+			t.status = "No test running"
+		}
+		t.cancel()
+	case "r":
+		if t.running != nil || t.probing {
+			t.status = "Wait for the running test to finish"
+		} else {
+			t.probe(servers)
+		}
+	}
+	return true
+}
+
+func (t *tui) move(n int) {
+	t.sel += n
+	if t.sel >= len(t.servers) {
+		t.sel = len(t.servers) - 1
+	}
+	if t.sel < 0 {
+		t.sel = 0
+	}
+}
+
+// probe latency tests the servers in the background
+func (t *tui) probe(servers []stdn.Testserver) {
+	t.probing = true
+	go func() {
+		probes := stdn.ProbeServers(servers, stdn.ProbeConfig{
+			Candidates: probeCandidates,
+			Workers:    probeWorkers,
+			Count:      basePingCount,
+			Deadline:   probeDeadline,
+		})
+		//best scoring first, with the servers which did not respond at the end
+		ranked := stdn.RankServers(probes, health, stdn.DefaultScoreWeights)
+		for _, pr := range probes {
+			if pr.Err != nil {
+				ranked = append(ranked, pr)
+			}
+		}
+		t.events <- probeEvent(ranked)
+	}()
+}
+
+// test starts a test of the phases on the selected server
+func (t *tui) test(phases string) {
+	if t.running != nil {
+		t.status = "A test is already running, press c to cancel it"
+		return
+	}
+	if len(t.servers) == 0 {
+		t.status = "No servers to test"
+		return
+	}
+	tp := stdn.NewTestPlan()
+	tp.ParsePhases(phases)
+	tp.PingCount = fullTestCount
+	tp.Duration = speedtestDuration
+	tp.Interface = interface_id
+	tp.LoadedLatency = true
+	tt := &tuiTest{
+		server: *t.servers[t.sel].Server,
+		phases: tp.Phases(),
+		cancel: make(chan struct{}),
+		start:  time.Now(),
+	}
+	tp.Cancel = tt.cancel
+	tp.Progress = func(p stdn.Progress) {
+		//progress is only for show, drop it rather than hold up the test
+		select {
+		case t.events <- progressEvent{tt, p}:
+		default:
+		}
+	}
+	tp.Report = func(p stdn.Phase, res *stdn.Result) {
+		t.events <- phaseEvent{tt, p, res.Latency}
+	}
+	t.running, t.last = tt, tt
+	go func() {
+		res, err := tt.server.Run(tp)
+		t.events <- doneEvent{tt, res, err}
+	}()
+}
+
+// cancel stops the running test, if any
+func (t *tui) cancel() {
+	if tt := t.running; tt != nil && !tt.canceled {
+		tt.canceled = true
+		close(tt.cancel)
+		t.status = "Canceling..."
+	}
+}
+
+func (t *tui) handle(ev interface{}) {
+	switch ev := ev.(type) {
+	case probeEvent:
+		t.probing = false
+		var id uint
+		if t.sel < len(t.servers) {
+			id = t.servers[t.sel].Server.ID
+		}
+		t.servers = ev
+		t.sel = 0
+		for i := range t.servers {
+			if t.servers[i].Server.ID == id {
+				t.sel = i
+			}
+		}
+	case progressEvent:
+		ev.t.progress = &ev.p
+		ev.t.rates = append(ev.t.rates, float64(ev.p.Bps))
+		if ev.p.Latency > 0 {
+			ev.t.loaded = append(ev.t.loaded, ms(ev.p.Latency))
+		}
+	case phaseEvent:
+		if ev.p == stdn.PhaseLatency {
+			ev.t.idle = ev.lat
+		}
+		ev.t.progress = nil
+		ev.t.phase++
+	case doneEvent:
+		ev.t.res, ev.t.err = ev.res, ev.err
+		t.running = nil
+		t.session = append(t.session, ev.t)
+		t.status = ""
+		if ev.err == stdn.ErrCanceled {
+			return
+		}
+		if err := hist.Append(stdn.NewHistoryEntry(t.cfg, ev.res, ev.err)); err != nil {
+			t.status = fmt.Sprintf("Failed to save result history: %v", err)
+		}
+		if err := updateHealth(ev.res, ev.err); err != nil {
+			t.status = fmt.Sprintf("Failed to save server health history: %v", err)
+		}
+	}
+}
+
+// screen accumulates the lines of a frame
+type screen struct {
+	w, h  int
+	lines []string
+}
+
+// add appends a line, padded or cut to the screen width, with an optional style
+func (s *screen) add(style, text string) {
+	if len(s.lines) >= s.h {
+		return
+	}
+	w := s.w
+	if len(s.lines) == s.h-1 {
+		//writing the last column of the last row scrolls some terminals
+		w--
+	}
+	s.lines = append(s.lines, style+fit(text, w)+styleReset)
+}
+
+// fit pads or truncates text to exactly w columns
+func fit(text string, w int) string {
+	n := utf8.RuneCountInString(text)
+	if n <= w {
+		return text + strings.Repeat(" ", w-n)
+	}
+	r := []rune(text)
+	return string(r[:w])
+}
+
+func (t *tui) draw() {
+	w, h, err := prompt.TerminalSize(os.Stdout)
+	if err != nil || w <= 0 || h <= 0 {
+		w, h = defaultGaugeWidth, 24
+	}
+	s := &screen{w: w, h: h}
+	if w < tuiMinWidth || h < tuiMinHeight {
+		s.add("", fmt.Sprintf("The terminal is too small, the dashboard needs %dx%d", tuiMinWidth, tuiMinHeight))
+		for len(s.lines) < h {
+			s.add("", "")
+		}
+		t.flush(s)
+		return
+	}
+	client := t.cfg.ISP
+	if t.cfg.IP != nil {
+		client = fmt.Sprintf("%s (%s)", t.cfg.IP, t.cfg.ISP)
+	}
+	s.add(styleReverse, " speedtest  "+client)
+
+	//share out the rows, the charts get what the lists do not need
+	rows := h - 2
+	srvRows := t.serverRows()
+	sessRows := len(t.session)
+	if sessRows < 2 {
+		sessRows = 2
+	}
+	chartRows := rows - (srvRows + 1) - (sessRows + 1) - (tuiLatencyRows + 2) - 2
+	if chartRows > tuiMaxChart {
+		chartRows = tuiMaxChart
+	}
+	if chartRows < 2 {
+		chartRows = 2
+	}
+	t.drawServers(s, srvRows)
+	s.add("", "")
+	t.drawTest(s, chartRows)
+	s.add("", "")
+	t.drawSession(s, h-1-len(s.lines)-1)
+	for len(s.lines) < h-1 {
+		s.add("", "")
+	}
+	if t.status != "" {
+		s.add(styleReverse, " "+t.status)
+	} else {
+		s.add(styleReverse, tuiKeys)
+	}
+	t.flush(s)
+}
+
+func (t *tui) flush(s *screen) {
+	var bb bytes.Buffer
+	bb.WriteString("\033[H")
+	bb.WriteString(strings.Join(s.lines, "\r\n"))
+	t.out.Write(bb.Bytes())
+}
+
+// serverRows is the number of server list rows to show
+func (t *tui) serverRows() int {
+	_, h, err := prompt.TerminalSize(os.Stdout)
+	if err != nil {
+		h = 24
+	}
+	n := len(t.servers)
+	if max := (h - 2) / 3; n > max {
+		n = max
+	}
+	if n < 3 {
+		n = 3
+	}
+	return n
+}
+
+func (t *tui) drawServers(s *screen, rows int) {
+	title := fmt.Sprintf("   %-8s %-26s %-22s %10s %9s %8s", "ID", "Sponsor", "Name", "Distance", "Latency", "Jitter")
+	if t.probing {
+		title += "   probing..."
+	}
+	s.add(styleBold, title)
+	//keep the selection in view
+	if t.sel < t.top {
+		t.top = t.sel
+	}
+	if t.sel >= t.top+rows {
+		t.top = t.sel - rows + 1
+	}
+	for i := t.top; i < t.top+rows; i++ {
+		if i >= len(t.servers) {
+			s.add("", "")
+			continue
+		}
+		pr := t.servers[i]
+		lat, jit := "timeout", ""
+		if pr.Err == nil {
+			lat = fmt.Sprintf("%.1fms", ms(pr.Latency))
+			jit = fmt.Sprintf("%.1fms", ms(pr.Jitter))
+		}
+		line := fmt.Sprintf("   %-8d %-26s %-22s %8.0fkm %9s %8s", pr.Server.ID,
+			clip(pr.Server.Sponsor, 26), clip(pr.Server.Name, 22), pr.Server.Distance, lat, jit)
+		if i == t.sel {
+			s.add(styleReverse, " >"+line[2:])
+		} else {
+			s.add("", line)
+		}
+	}
+}
+
+// clip cuts text to at most n columns
+func clip(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	return string([]rune(text)[:n])
+}
+
+func (t *tui) drawTest(s *screen, chartRows int) {
+	tt := t.last
+	if tt == nil {
+		s.add(styleBold, "Test")
+		s.add("", "  Select a server and press enter to run a test")
+		for i := 1; i < chartRows+tuiLatencyRows+1; i++ {
+			s.add("", "")
+		}
+		return
+	}
+	s.add(styleBold, "Test: "+t.testState(tt))
+	chartW := s.w - 14
+	var peak float64
+	for _, v := range tt.rates {
+		if v > peak {
+			peak = v
+		}
+	}
+	for i, line := range chart(tt.rates, chartW, chartRows) {
+		label := ""
+		if i == 0 && peak > 0 {
+			label = humanSpeed(uint64(peak))
+		}
+		s.add("", fmt.Sprintf("%12s %s", label, line))
+	}
+	lat := "Loaded latency"
+	if tt.idle != nil {
+		lat += fmt.Sprintf(", idle median %.1fms", ms(tt.idle.Median))
+	}
+	if n := len(tt.loaded); n > 0 {
+		lat += fmt.Sprintf(", now %.1fms", tt.loaded[n-1])
+	}
+	s.add("", lat)
+	var worst float64
+	for _, v := range tt.loaded {
+		if v > worst {
+			worst = v
+		}
+	}
+	for i, line := range chart(tt.loaded, chartW, tuiLatencyRows) {
+		label := ""
+		if i == 0 && worst > 0 {
+			label = fmt.Sprintf("%.0fms", worst)
+		}
+		s.add("", fmt.Sprintf("%12s %s", label, line))
+	}
+}
+
+// testState describes what a test is doing, or how it ended
+func (t *tui) testState(tt *tuiTest) string {
+	srv := fmt.Sprintf("%d %s (%s)", tt.server.ID, tt.server.Sponsor, tt.server.Name)
+	if tt.res == nil {
+		phase := ""
+		if tt.phase < len(tt.phases) {
+			phase = string(tt.phases[tt.phase])
+		}
+		state := fmt.Sprintf("%s  %s  %.0fs", srv, phase, time.Since(tt.start).Seconds())
+		if p := tt.progress; p != nil {
+			state += fmt.Sprintf("  %s  %s", humanSpeed(p.Bps), units.Size(p.Bytes))
+		}
+		return state
+	}
+	if tt.err != nil {
+		return srv + "  " + tuiError(tt.err)
+	}
+	return fmt.Sprintf("%s  finished in %.1fs", srv, tt.res.End.Sub(tt.res.Start).Seconds())
+}
+
+func tuiError(err error) string {
+	_, msg := testError(err)
+	return strings.Replace(msg.Error(), "\n", " ", -1)
+}
+
+// chart draws vals as a bar chart h rows high, scaled to the largest value,
+// showing the most recent values when there are more than fit in w columns
+func chart(vals []float64, w, h int) []string {
+	if len(vals) > w {
+		vals = vals[len(vals)-w:]
+	}
+	var max float64
+	for _, v := range vals {
+		if v > max {
+			max = v
+		}
+	}
+	steps := []rune(" ▁▂▃▄▅▆▇█")
+	lines := make([]string, h)
+	for row := 0; row < h; row++ {
+		var sb strings.Builder
+		floor := float64(h-row-1) * 8 //eighths below this row
+		for _, v := range vals {
+			level := 0.0
+			if max > 0 {
+				level = v/max*float64(h*8) - floor
+			}
+			switch {
+			case level >= 8:
+				sb.WriteRune(steps[8])
+			case level >= 1:
+				sb.WriteRune(steps[int(level)])
+			case row == h-1 && v > 0:
+				//never hide a non-zero value entirely
+				sb.WriteRune(steps[1])
+			default:
+				sb.WriteRune(' ')
+			}
+		}
+		lines[row] = sb.String()
+	}
+	return lines
+}
+
+// drawSession lists the tests of this session, marking the best of each measurement
+func (t *tui) drawSession(s *screen, rows int) {
+	s.add(styleBold, fmt.Sprintf(" %-9s %-8s %-26s %10s %10s %16s %16s  %s",
+		"Time", "ID", "Sponsor", "Latency", "Loaded", "Download", "Upload", "Latency trend"))
+	best := sessionBest(t.session)
+	//show the most recent tests when they do not all fit
+	first := 0
+	if len(t.session) > rows {
+		first = len(t.session) - rows
+	}
+	for _, tt := range t.session[first:] {
+		line := fmt.Sprintf(" %-9s %-8d %-26s ", tt.start.Format("15:04:05"), tt.server.ID, clip(tt.server.Sponsor, 26))
+		if tt.err != nil {
+			s.add("", line+tuiError(tt.err))
+			continue
+		}
+		res := tt.res
+		lat, loaded, dl, ul, trend := "", "", "", "", ""
+		if res.Latency != nil {
+			lat = markBest(fmt.Sprintf("%.1fms", ms(res.Latency.Median)), best.latency == tt)
+			var samples []float64
+			for _, d := range res.Latency.Samples {
+				samples = append(samples, ms(d))
+			}
+			trend = spark.Line(samples)
+		}
+		if d := loadedMedian(res); d > 0 {
+			loaded = markBest(fmt.Sprintf("%.1fms", ms(d)), best.loaded == tt)
+		}
+		if res.Download != nil {
+			dl = markBest(humanSpeed(res.Download.Bps), best.download == tt)
+		}
+		if res.Upload != nil {
+			ul = markBest(humanSpeed(res.Upload.Bps), best.upload == tt)
+		}
+		s.add("", line+fmt.Sprintf("%10s %10s %16s %16s  %s", lat, loaded, dl, ul, trend))
+	}
+}
+
+func markBest(v string, best bool) string {
+	if best {
+		return "*" + v
+	}
+	return v
+}
+
+type sessionBests struct {
+	latency, loaded, download, upload *tuiTest
+}
+
+func sessionBest(session []*tuiTest) (b sessionBests) {
+	//only worth marking when there is something to compare
+	if len(session) < 2 {
+		return
+	}
+	for _, tt := range session {
+		res := tt.res
+		if tt.err != nil || res == nil {
+			continue
+		}
+		if res.Latency != nil && (b.latency == nil || res.Latency.Median < b.latency.res.Latency.Median) {
+			b.latency = tt
+		}
+		if d := loadedMedian(res); d > 0 && (b.loaded == nil || d < loadedMedian(b.loaded.res)) {
+			b.loaded = tt
+		}
+		if res.Download != nil && (b.download == nil || res.Download.Bps > b.download.res.Download.Bps) {
+			b.download = tt
+		}
+		if res.Upload != nil && (b.upload == nil || res.Upload.Bps > b.upload.res.Upload.Bps) {
+			b.upload = tt
+		}
+	}
+	return
+}
+
+// loadedMedian is the worst median latency of the bandwidth phases
+func loadedMedian(res *stdn.Result) (d time.Duration) {
+	for _, xfer := range []*stdn.Transfer{res.Download, res.Upload} {
+		if xfer != nil && xfer.Loaded != nil && xfer.Loaded.Median > d {
+			d = xfer.Loaded.Median
+		}
+	}
+	return
+}